@@ -0,0 +1,15 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// AgeIdentityFileEnv names the environment variable holding the path of the
+// age identity file used to decrypt age secrets.
+const AgeIdentityFileEnv = internal.AgeIdentityFileEnv
+
+// SetAgeIdentityFile sets the path of the age identity file, as generated by
+// age-keygen, used to decrypt age secrets. It takes precedence over the
+// SECRETCRYPT_AGE_IDENTITY_FILE environment variable. Passing "" removes the
+// override.
+func SetAgeIdentityFile(path string) {
+	internal.SetAgeIdentityFile(path)
+}
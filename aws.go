@@ -0,0 +1,19 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// AWSConfig configures the AWS sessions used by AWS backed crypters, such as
+// the profile, a role to assume, a custom endpoint or HTTP client, or a
+// complete custom session.
+type AWSConfig = internal.AWSConfig
+
+// SetAWSConfig sets the AWS configuration used for all regions that have no
+// region specific configuration.
+func SetAWSConfig(config AWSConfig) {
+	internal.SetAWSConfig(config)
+}
+
+// SetRegionAWSConfig sets the AWS configuration used for the given region.
+func SetRegionAWSConfig(region string, config AWSConfig) {
+	internal.SetRegionAWSConfig(region, config)
+}
@@ -0,0 +1,26 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// AzureKeyVaultConfig configures how the azurekv crypter authenticates to
+// Azure Key Vault.
+type AzureKeyVaultConfig = internal.AzureKeyVaultConfig
+
+// AzureTokenSource supplies access tokens for the Key Vault resource,
+// https://vault.azure.net. A zero expiry means the token is not cached.
+type AzureTokenSource = internal.AzureTokenSource
+
+// AzureStaticToken uses a fixed access token, e.g. from
+// `az account get-access-token --resource https://vault.azure.net`.
+type AzureStaticToken = internal.AzureStaticToken
+
+// AzureManagedIdentityTokenSource gets access tokens of a managed identity
+// from the Azure Instance Metadata Service. It is the default unless
+// AZURE_ACCESS_TOKEN is set.
+type AzureManagedIdentityTokenSource = internal.AzureManagedIdentityTokenSource
+
+// SetAzureKeyVaultConfig sets how the azurekv crypter authenticates to Azure
+// Key Vault. A token cached for the previous configuration is dropped.
+func SetAzureKeyVaultConfig(config AzureKeyVaultConfig) {
+	internal.SetAzureKeyVaultConfig(config)
+}
@@ -22,17 +22,66 @@ func decryptSecret(secretStr string) {
 	fmt.Println(plaintext)
 }
 
+func awsConfig(arguments map[string]interface{}) secretcrypt.AWSConfig {
+	var config secretcrypt.AWSConfig
+	if profile, ok := arguments["--profile"].(string); ok {
+		config.Profile = profile
+	}
+	if roleARN, ok := arguments["--role-arn"].(string); ok {
+		config.RoleARN = roleARN
+	}
+	if endpoint, ok := arguments["--endpoint-url"].(string); ok {
+		config.Endpoint = endpoint
+	}
+	return config
+}
+
 func main() {
 	usage := `Encrypted secrets.
 
 Usage:
-  decrypt-secret [options] <secret>
+  decrypt-secret [options] [--allowed-key=<arn>]... <secret>
 
 Options:
   --help
-  --profile=<profile>		    AWS Profile Name [default: default]
+  --profile=<profile>       AWS Profile Name
+  --role-arn=<arn>          AWS role to assume
+  --endpoint-url=<url>      Custom AWS endpoint URL
+  --allowed-key=<arn>       Only decrypt KMS secrets protected by this key ARN (repeatable)
+  --vault-addr=<url>        Vault server URL (default: $VAULT_ADDR)
+  --age-identity=<path>     age identity file (default: $SECRETCRYPT_AGE_IDENTITY_FILE)
+  --pgp-keyring=<path>      OpenPGP keyring with the private keys (default: $SECRETCRYPT_PGP_KEYRING)
+  --ssh-identity=<path>     SSH private key (default: $SECRETCRYPT_SSH_IDENTITY_FILE, ~/.ssh/id_ed25519 or ~/.ssh/id_rsa)
+  --password-file=<path>    Read the password or key passphrase from a file instead of prompting
+  --password-env=<name>     Read the password or key passphrase from an environment variable instead of prompting
 `
 	arguments, _ := docopt.Parse(usage, nil, true, "0.1", false)
 
+	secretcrypt.SetAWSConfig(awsConfig(arguments))
+	secretcrypt.SetKMSAllowedKeys(arguments["--allowed-key"].([]string)...)
+	if vaultAddr, ok := arguments["--vault-addr"].(string); ok {
+		secretcrypt.SetVaultConfig(secretcrypt.VaultConfig{Address: vaultAddr})
+	}
+	if ageIdentity, ok := arguments["--age-identity"].(string); ok {
+		secretcrypt.SetAgeIdentityFile(ageIdentity)
+	}
+
+	if pgpKeyring, ok := arguments["--pgp-keyring"].(string); ok {
+		secretcrypt.SetPGPKeyring(pgpKeyring)
+	}
+	if sshIdentity, ok := arguments["--ssh-identity"].(string); ok {
+		secretcrypt.SetSSHIdentityFile(sshIdentity)
+	}
+
+	var passwordProvider secretcrypt.PasswordProvider
+	if passwordFile, ok := arguments["--password-file"].(string); ok {
+		passwordProvider = secretcrypt.FilePasswordProvider{Path: passwordFile}
+	} else if passwordEnv, ok := arguments["--password-env"].(string); ok {
+		passwordProvider = secretcrypt.EnvPasswordProvider{Name: passwordEnv}
+	}
+	secretcrypt.SetPasswordProvider(passwordProvider)
+	secretcrypt.SetPGPPassphraseProvider(passwordProvider)
+	secretcrypt.SetSSHPassphraseProvider(passwordProvider)
+
 	decryptSecret(arguments["<secret>"].(string))
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/Zemanta/go-secretcrypt/internal"
 	"github.com/docopt/docopt-go"
@@ -23,52 +27,265 @@ func encryptSecret(crypter internal.Crypter, plaintext string, encryptParams int
 	), nil
 }
 
+func readPlaintext(multiline bool) (string, error) {
+	// do not print prompt if input is being piped
+	if isatty.IsTerminal(os.Stdin.Fd()) {
+		fmt.Fprintf(os.Stderr, "Enter plaintext: ")
+	}
+
+	if multiline {
+		fmt.Fprintf(os.Stderr, "\n")
+		plainbytes, err := ioutil.ReadAll(os.Stdin)
+		return string(plainbytes), err
+	}
+	var plaintext string
+	_, err := fmt.Scanln(&plaintext)
+	return plaintext, err
+}
+
+// encryptBatch encrypts each line of the input as a separate secret and
+// writes the secrets one per line. kms secrets are envelope encrypted under a
+// single data key, at the cost of one GenerateDataKey call.
+func encryptBatch(crypter internal.Crypter, input io.Reader, output io.Writer, encryptParams internal.EncryptParams) error {
+	if crypter.Name() == "kms" {
+		encryptParams["envelope"] = "true"
+		internal.EnableKMSDataKeyCache(internal.DataKeyCacheConfig{MaxAge: time.Hour})
+		defer internal.DisableKMSDataKeyCache()
+	}
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		secret, err := encryptSecret(crypter, scanner.Text(), encryptParams)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(output, secret)
+	}
+	return scanner.Err()
+}
+
+func awsConfig(arguments map[string]interface{}) internal.AWSConfig {
+	var config internal.AWSConfig
+	if profile, ok := arguments["--profile"].(string); ok {
+		config.Profile = profile
+	}
+	if roleARN, ok := arguments["--role-arn"].(string); ok {
+		config.RoleARN = roleARN
+	}
+	if endpoint, ok := arguments["--endpoint-url"].(string); ok {
+		config.Endpoint = endpoint
+	}
+	return config
+}
+
+func addEncryptionContext(arguments map[string]interface{}, encryptParams internal.EncryptParams) error {
+	for _, pair := range arguments["--context"].([]string) {
+		tokens := strings.SplitN(pair, "=", 2)
+		if len(tokens) != 2 || tokens[0] == "" {
+			return fmt.Errorf("Invalid encryption context, expected key=value: %s", pair)
+		}
+		encryptParams["context."+tokens[0]] = tokens[1]
+	}
+	return nil
+}
+
+func addCrypterParams(arguments map[string]interface{}, encryptParams internal.EncryptParams) error {
+	for _, pair := range arguments["--param"].([]string) {
+		tokens := strings.SplitN(pair, "=", 2)
+		if len(tokens) != 2 || !strings.Contains(tokens[0], ".") {
+			return fmt.Errorf("Invalid crypter parameter, expected crypter.key=value: %s", pair)
+		}
+		encryptParams[tokens[0]] = tokens[1]
+	}
+	return nil
+}
+
 func main() {
 	usage := `Encrypts secrets. Reads secrets as user input or from standard input.
 
 Usage:
-  encrypt-secret [options] kms <key_id>
+  encrypt-secret [options] [--context=<key_value>]... [--fallback=<region>]... kms <key_id>
   encrypt-secret [options] local
   encrypt-secret [options] password
+  encrypt-secret [options] vault <key_name>
+  encrypt-secret [options] [--context=<key_value>]... gcpkms <key_resource>
+  encrypt-secret [options] azurekv <vault_url> <key_name>
+  encrypt-secret [options] age <recipient>...
+  encrypt-secret [options] pgp <recipient>...
+  encrypt-secret [options] ssh <authorized_keys>...
+  encrypt-secret [options] [--param=<key_value>]... multi <crypter>...
+  encrypt-secret [options] [--param=<key_value>]... shamir --threshold=<k> <crypter>...
+  encrypt-secret [options] ssm <parameter_name>
 
 Options:
   --help
   --region=<region_name>    AWS Region Name [default: us-east-1]
+  --profile=<profile>       AWS Profile Name
+  --role-arn=<arn>          AWS role to assume
+  --endpoint-url=<url>      Custom AWS endpoint URL
   --multiline               Multiline input (read stdin bytes until EOF)
+  --batch                   Encrypt each line of stdin as a separate secret, kms ones envelope encrypted under one data key
+  --context=<key_value>     KMS or Cloud KMS encryption context pair, e.g. service=myservice (repeatable)
+  --fallback=<region>       Region to decrypt in if the primary region fails, for multi-Region keys (repeatable)
+  --envelope                Encrypt locally with a KMS data key, also used for plaintexts over 4 KB
+  --vault-addr=<url>        Vault server URL (default: $VAULT_ADDR)
+  --vault-mount=<path>      Vault Transit secrets engine mount path [default: transit]
+  --azure-key-version=<v>   Azure Key Vault key version (default: latest)
+  --azure-key-alg=<alg>     Azure Key Vault key wrapping algorithm [default: RSA-OAEP-256]
+  --ssm-version=<v>         Pin the SSM parameter version (default: latest)
+  --pgp-keyring=<path>      OpenPGP keyring with the recipients' public keys (default: $SECRETCRYPT_PGP_KEYRING)
+  --ssh-agent               Encrypt ssh secrets for decryption through the ssh-agent holding the keys ($SSH_AUTH_SOCK), only to keys in your own agent
+  --param=<key_value>       Parameter of a multi or shamir crypter, e.g. kms.keyID=alias/mykey or kms.2.region=eu-west-1 (repeatable)
+  --threshold=<k>           Number of shamir key shares required for decryption
+  --password-file=<path>    Read the password from a file instead of prompting
+  --password-env=<name>     Read the password from an environment variable instead of prompting
+  --password-id=<id>        Identifies the password so that it is only asked for once when decrypting
+  --kdf=<kdf>               Password key derivation function, scrypt or argon2id [default: scrypt]
+  --scrypt-n=<n>            scrypt CPU/memory cost of the password key, a power of 2 (default: 32768)
+  --scrypt-r=<r>            scrypt block size of the password key (default: 8)
+  --scrypt-p=<p>            scrypt parallelization of the password key (default: 1)
+  --argon2-m=<kib>          Argon2id memory of the password key in KiB (default: 65536)
+  --argon2-t=<t>            Argon2id iterations of the password key (default: 3)
+  --argon2-p=<p>            Argon2id parallelism of the password key (default: 4)
 `
 
 	arguments, _ := docopt.Parse(usage, nil, true, "0.1", false)
 
+	internal.SetAWSConfig(awsConfig(arguments))
+
 	var crypter internal.Crypter
 	var encryptParams = make(internal.EncryptParams)
 	if arguments["kms"].(bool) {
-		crypter = internal.CryptersMap["kms"]
+		crypter, _ = internal.GetCrypter("kms")
 		encryptParams["region"] = arguments["--region"].(string)
 		encryptParams["keyID"] = arguments["<key_id>"].(string)
+		if fallbackRegions := arguments["--fallback"].([]string); len(fallbackRegions) > 0 {
+			encryptParams["fallbackRegions"] = strings.Join(fallbackRegions, ",")
+		}
+		if arguments["--envelope"].(bool) {
+			encryptParams["envelope"] = "true"
+		}
+		if err := addEncryptionContext(arguments, encryptParams); err != nil {
+			fmt.Println(err)
+			return
+		}
 	} else if arguments["local"].(bool) {
-		crypter = internal.CryptersMap["local"]
+		crypter, _ = internal.GetCrypter("local")
 	} else if arguments["password"].(bool) {
-		crypter = internal.CryptersMap["password"]
+		crypter, _ = internal.GetCrypter("password")
+		if passwordID, ok := arguments["--password-id"].(string); ok {
+			encryptParams["passwordID"] = passwordID
+		}
+		encryptParams["kdf"] = arguments["--kdf"].(string)
+		if scryptN, ok := arguments["--scrypt-n"].(string); ok {
+			encryptParams["scryptN"] = scryptN
+		}
+		if scryptR, ok := arguments["--scrypt-r"].(string); ok {
+			encryptParams["scryptR"] = scryptR
+		}
+		if scryptP, ok := arguments["--scrypt-p"].(string); ok {
+			encryptParams["scryptP"] = scryptP
+		}
+		if argon2Memory, ok := arguments["--argon2-m"].(string); ok {
+			encryptParams["argon2Memory"] = argon2Memory
+		}
+		if argon2Iterations, ok := arguments["--argon2-t"].(string); ok {
+			encryptParams["argon2Iterations"] = argon2Iterations
+		}
+		if argon2Parallelism, ok := arguments["--argon2-p"].(string); ok {
+			encryptParams["argon2Parallelism"] = argon2Parallelism
+		}
+	} else if arguments["vault"].(bool) {
+		crypter, _ = internal.GetCrypter("vault")
+		encryptParams["mount"] = arguments["--vault-mount"].(string)
+		encryptParams["key"] = arguments["<key_name>"].(string)
+	} else if arguments["gcpkms"].(bool) {
+		crypter, _ = internal.GetCrypter("gcpkms")
+		encryptParams["key"] = arguments["<key_resource>"].(string)
+		if err := addEncryptionContext(arguments, encryptParams); err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else if arguments["azurekv"].(bool) {
+		crypter, _ = internal.GetCrypter("azurekv")
+		encryptParams["vault"] = arguments["<vault_url>"].(string)
+		encryptParams["key"] = arguments["<key_name>"].(string)
+		encryptParams["algorithm"] = arguments["--azure-key-alg"].(string)
+		if version, ok := arguments["--azure-key-version"].(string); ok {
+			encryptParams["version"] = version
+		}
+	} else if arguments["age"].(bool) {
+		crypter, _ = internal.GetCrypter("age")
+		encryptParams["recipients"] = strings.Join(arguments["<recipient>"].([]string), ",")
+	} else if arguments["pgp"].(bool) {
+		crypter, _ = internal.GetCrypter("pgp")
+		encryptParams["recipients"] = strings.Join(arguments["<recipient>"].([]string), ",")
+		if keyring, ok := arguments["--pgp-keyring"].(string); ok {
+			encryptParams["keyring"] = keyring
+		}
+	} else if arguments["ssh"].(bool) {
+		crypter, _ = internal.GetCrypter("ssh")
+		var authorizedKeys []string
+		for _, path := range arguments["<authorized_keys>"].([]string) {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				fmt.Println("Error reading SSH public keys:", err)
+				return
+			}
+			authorizedKeys = append(authorizedKeys, string(contents))
+		}
+		encryptParams["recipients"] = strings.Join(authorizedKeys, "\n")
+		if arguments["--ssh-agent"].(bool) {
+			encryptParams["agent"] = "true"
+		}
+	} else if arguments["multi"].(bool) {
+		crypter, _ = internal.GetCrypter("multi")
+		encryptParams["crypters"] = strings.Join(arguments["<crypter>"].([]string), ",")
+		if err := addCrypterParams(arguments, encryptParams); err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else if arguments["shamir"].(bool) {
+		crypter, _ = internal.GetCrypter("shamir")
+		encryptParams["crypters"] = strings.Join(arguments["<crypter>"].([]string), ",")
+		encryptParams["threshold"] = arguments["--threshold"].(string)
+		if err := addCrypterParams(arguments, encryptParams); err != nil {
+			fmt.Println(err)
+			return
+		}
+	} else if arguments["ssm"].(bool) {
+		crypter, _ = internal.GetCrypter("ssm")
+		encryptParams["region"] = arguments["--region"].(string)
+		encryptParams["name"] = arguments["<parameter_name>"].(string)
+		if version, ok := arguments["--ssm-version"].(string); ok {
+			encryptParams["version"] = version
+		}
+	}
+	if vaultAddr, ok := arguments["--vault-addr"].(string); ok {
+		internal.SetVaultConfig(internal.VaultConfig{Address: vaultAddr})
+	}
+	if passwordFile, ok := arguments["--password-file"].(string); ok {
+		internal.SetPasswordProvider(internal.FilePasswordProvider{Path: passwordFile})
+	} else if passwordEnv, ok := arguments["--password-env"].(string); ok {
+		internal.SetPasswordProvider(internal.EnvPasswordProvider{Name: passwordEnv})
 	}
 
-	// do not print prompt if input is being piped
-	if isatty.IsTerminal(os.Stdin.Fd()) {
-		fmt.Fprintf(os.Stderr, "Enter plaintext: ")
+	if arguments["--batch"].(bool) {
+		if err := encryptBatch(crypter, os.Stdin, os.Stdout, encryptParams); err != nil {
+			fmt.Println("Error encrypting:", err)
+		}
+		return
 	}
 
+	// ssm secrets reference values kept in Parameter Store, so there is no
+	// plaintext to read
 	var plaintext string
-	var err error
-	if arguments["--multiline"].(bool) {
-		fmt.Fprintf(os.Stderr, "\n")
-		var plainbytes []byte
-		plainbytes, err = ioutil.ReadAll(os.Stdin)
-		plaintext = string(plainbytes)
-	} else {
-		_, err = fmt.Scanln(&plaintext)
-	}
-	if err != nil {
-		fmt.Println("Invalid plaintext input!", err)
-		return
+	if !arguments["ssm"].(bool) {
+		var err error
+		plaintext, err = readPlaintext(arguments["--multiline"].(bool))
+		if err != nil {
+			fmt.Println("Invalid plaintext input!", err)
+			return
+		}
 	}
 	secret, err := encryptSecret(crypter, plaintext, encryptParams)
 	if err != nil {
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Zemanta/go-secretcrypt/internal"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeKMSClient struct {
+	kmsiface.KMSAPI
+	dataKeys *int
+}
+
+func (c fakeKMSClient) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	*c.dataKeys++
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      bytes.Repeat([]byte{byte(*c.dataKeys)}, 32),
+		CiphertextBlob: []byte{byte(*c.dataKeys)},
+		KeyId:          aws.String("arn:aws:kms:us-east-1:123456789012:key/mykey"),
+	}, nil
+}
+
+func TestEncryptBatchKMS(t *testing.T) {
+	defer internal.SetKMSClientFactory(nil)
+	dataKeys := 0
+	internal.SetKMSClientFactory(func(region string) (kmsiface.KMSAPI, error) {
+		return fakeKMSClient{dataKeys: &dataKeys}, nil
+	})
+
+	crypter, _ := internal.GetCrypter("kms")
+	var output bytes.Buffer
+	err := encryptBatch(crypter, strings.NewReader("dbpass\napitoken\nsmtppass\n"), &output, internal.EncryptParams{
+		"region": "us-east-1",
+		"keyID":  "alias/mykey",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dataKeys)
+
+	secrets := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Len(t, secrets, 3)
+	for _, secret := range secrets {
+		assert.True(t, strings.HasPrefix(secret, "kms:datakey=AQ%3D%3D&"), secret)
+	}
+
+	// the data key is not reused beyond the batch
+	err = encryptBatch(crypter, strings.NewReader("dbpass\n"), &output, internal.EncryptParams{
+		"region": "us-east-1",
+		"keyID":  "alias/mykey",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dataKeys)
+}
@@ -0,0 +1,46 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// Crypter is an object that knows how to encrypt and decrypt a secret.
+// Implement it to add your own backend and register it with RegisterCrypter.
+type Crypter = internal.Crypter
+
+// ContextCrypter is a Crypter whose decryption can be bounded and cancelled
+// with a context. Crypters that only implement Crypter still work with
+// StrictSecret.DecryptContext, but their decryption runs to completion in the
+// background after the context is done.
+type ContextCrypter = internal.ContextCrypter
+
+// Ciphertext is the encrypted plaintext.
+type Ciphertext = internal.Ciphertext
+
+// EncryptParams are parameters used for encrypting a secret.
+type EncryptParams = internal.EncryptParams
+
+// DecryptParams are parameters used for decrypting a secret. They are stored
+// in the secret's textual representation alongside the ciphertext.
+type DecryptParams = internal.DecryptParams
+
+// VersionParam is the reserved decrypt parameter holding the format version of
+// a secret. Built-in crypters write it on encryption and reject versions they
+// do not know on decryption. Secrets without it are version 1.
+const VersionParam = internal.VersionParam
+
+// RegisterCrypter makes a crypter available for secrets prefixed with the
+// given name. It is typically called from an init() function. It returns an
+// error if the name is empty, contains a colon or is already registered.
+func RegisterCrypter(name string, crypter Crypter) error {
+	return internal.RegisterCrypter(name, crypter)
+}
+
+// UnregisterCrypter removes the crypter registered under the given name and
+// reports whether it was registered.
+func UnregisterCrypter(name string) bool {
+	return internal.UnregisterCrypter(name)
+}
+
+// Crypters returns a snapshot of all registered crypters keyed by name.
+func Crypters() map[string]Crypter {
+	return internal.Crypters()
+}
@@ -14,23 +14,33 @@ key aliased MyKey:
 
   $ encrypt-secret kms alias/MyKey
   Enter plaintext: VerySecretValue! # enter
-  kms:region=us-east-1:CiC/SXeuXDGRADRIjc0qcE... # shortened for brevity
+  kms:key=arn%3Aaws%3Akms%3Aus-east-1%3A123456789012%3Akey%2F1234abcd&region=us-east-1&v=1:CiC/SXeuXDGRADRIjc0qcE... # shortened for brevity
 
   # --- or --
   $ echo "VerySecretValue!" | encrypt-secret kms alias/MyKey
-  kms:region=us-east-1:CiC/SXeuXDGRADRIjc0qcE... # shortened for brevity
+  kms:key=arn%3Aaws%3Akms%3Aus-east-1%3A123456789012%3Akey%2F1234abcd&region=us-east-1&v=1:CiC/SXeuXDGRADRIjc0qcE... # shortened for brevity
   # only use piping when scripting, otherwise your secrets will be stored
   # in your shell's history!
 
 use that secret in my TOML config file:
 
-  MySecret = "kms:region=us-east-1:CiC/SXeuXDGRADRIjc0qcE..."  # shortened for brevity
+  MySecret = "kms:key=arn%3Aaws%3Akms%3Aus-east-1%3A123456789012%3Akey%2F1234abcd&region=us-east-1&v=1:CiC/SXeuXDGRADRIjc0qcE..."  # shortened for brevity
 
 or YAML:
-  mysecret: kms:region=us-east-1:CiC/SXeuXDGRADRIjc0qcE...  # shortened for brevity
+  mysecret: kms:key=arn%3Aaws%3Akms%3Aus-east-1%3A123456789012%3Akey%2F1234abcd&region=us-east-1&v=1:CiC/SXeuXDGRADRIjc0qcE...  # shortened for brevity
 
 or JSON:
-   {"MySecret": "kms:region=us-east-1:CiC/SXeuXDGRADRIjc0qcE..."}
+   {"MySecret": "kms:key=arn%3Aaws%3Akms%3Aus-east-1%3A123456789012%3Akey%2F1234abcd&region=us-east-1&v=1:CiC/SXeuXDGRADRIjc0qcE..."}
+
+The key parameter records the ARN of the KMS key that encrypted the secret,
+and decryption asks KMS to use exactly that key. Since anyone who can edit the
+config file can change it, restrict which keys your service decrypts with
+before loading the config:
+
+  secretcrypt.SetKMSAllowedKeys("arn:aws:kms:us-east-1:123456789012:key/1234abcd")
+
+Secrets protected by any other key then fail to decrypt. Without an
+allowlist, any key is accepted.
 
 Then, you can use that secret in your config struct
 
@@ -60,6 +70,11 @@ So if you use a custom region, you must provide it to secretcrypt:
 
   encrypt-secret kms --region us-west-1 alias/MyKey
 
+To bind a secret to a service or environment, pass a KMS encryption context.
+It is stored in the secret and passed back to KMS on decryption:
+
+  encrypt-secret --context service=myservice kms alias/MyKey
+
 
 Local encryption
 
@@ -69,5 +84,18 @@ It generates a local key in your user data dir
 be accidentally committed to CVS.
 
 It then uses that key to symmetrically encrypt and decrypt your secrets.
+
+Custom crypters
+
+You can plug in your own encryption backend by implementing the Crypter
+interface and registering it, typically from your package's init():
+
+  func init() {
+    if err := secretcrypt.RegisterCrypter("mycrypter", MyCrypter{}); err != nil {
+      panic(err)
+    }
+  }
+
+Secrets prefixed with "mycrypter:" are then decrypted by your crypter.
 */
 package secretcrypt
@@ -0,0 +1,30 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// GCPKMSEndpointEnv names the environment variable overriding the Cloud KMS
+// endpoint, e.g. to use a local emulator.
+const GCPKMSEndpointEnv = internal.GCPKMSEndpointEnv
+
+// GCPKMSConfig configures how the gcpkms crypter reaches and authenticates to
+// Google Cloud KMS.
+type GCPKMSConfig = internal.GCPKMSConfig
+
+// GCPTokenSource supplies OAuth2 access tokens for Google Cloud APIs. A zero
+// expiry means the token is not cached.
+type GCPTokenSource = internal.GCPTokenSource
+
+// GCPStaticToken uses a fixed access token, e.g. from
+// `gcloud auth print-access-token`.
+type GCPStaticToken = internal.GCPStaticToken
+
+// GCPMetadataTokenSource gets access tokens of the default service account
+// from the GCE metadata server, as available on GCE, GKE and Cloud Run. It is
+// the default unless GOOGLE_OAUTH_ACCESS_TOKEN is set.
+type GCPMetadataTokenSource = internal.GCPMetadataTokenSource
+
+// SetGCPKMSConfig sets how the gcpkms crypter reaches and authenticates to
+// Cloud KMS. A token cached for the previous configuration is dropped.
+func SetGCPKMSConfig(config GCPKMSConfig) {
+	internal.SetGCPKMSConfig(config)
+}
@@ -1,11 +1,25 @@
 module github.com/Zemanta/go-secretcrypt
 
-go 1.12
+go 1.17
 
 require (
+	filippo.io/age v1.0.0
+	github.com/ProtonMail/go-crypto v1.0.0
 	github.com/aws/aws-sdk-go v1.44.51
 	github.com/docopt/docopt-go v0.0.0-20180111231733-ee0de3bc6815
 	github.com/mattn/go-isatty v0.0.14
 	github.com/stretchr/testify v1.8.0
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/crypto v0.7.0
+)
+
+require (
+	filippo.io/edwards25519 v1.0.0-rc.1 // indirect
+	github.com/cloudflare/circl v1.3.3 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.4.0 // indirect
+	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/term v0.6.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
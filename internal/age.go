@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+)
+
+// AgeCrypter encrypts secrets to one or more age X25519 recipients, so that
+// each holder of a matching identity can decrypt them offline.
+type AgeCrypter struct{}
+
+const ageVersion = "1"
+
+// AgeIdentityFileEnv names the environment variable holding the path of the
+// age identity file used for decryption.
+const AgeIdentityFileEnv = "SECRETCRYPT_AGE_IDENTITY_FILE"
+
+var ageIdentityFile string
+var ageIdentityFileLock sync.RWMutex
+
+// SetAgeIdentityFile sets the path of the age identity file used for
+// decryption. It takes precedence over the SECRETCRYPT_AGE_IDENTITY_FILE
+// environment variable. Passing "" removes the override.
+func SetAgeIdentityFile(path string) {
+	ageIdentityFileLock.Lock()
+	defer ageIdentityFileLock.Unlock()
+	ageIdentityFile = path
+}
+
+func ageIdentities() ([]age.Identity, error) {
+	ageIdentityFileLock.RLock()
+	path := ageIdentityFile
+	ageIdentityFileLock.RUnlock()
+	if path == "" {
+		path = os.Getenv(AgeIdentityFileEnv)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("No age identity file, set %s or configure the identity file", AgeIdentityFileEnv)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading age identity file: %s", err)
+	}
+	defer wipe(contents)
+	identities, err := age.ParseIdentities(bytes.NewReader(contents))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing age identity file %s: %s", path, err)
+	}
+	return identities, nil
+}
+
+func (c AgeCrypter) Name() string {
+	return "age"
+}
+
+func (c AgeCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	var recipients []age.Recipient
+	for _, publicKey := range strings.Split(encryptParams["recipients"], ",") {
+		if publicKey = strings.TrimSpace(publicKey); publicKey == "" {
+			continue
+		}
+		recipient, err := age.ParseX25519Recipient(publicKey)
+		if err != nil {
+			return Ciphertext(""), nil, fmt.Errorf("Invalid age recipient '%s': %s", publicKey, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		return Ciphertext(""), nil, fmt.Errorf("Missing recipients parameter!")
+	}
+
+	ciphertext, err := ageEncrypt(plaintext, recipients)
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+	return ciphertext, withVersion(ageVersion, nil), nil
+}
+
+func (c AgeCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(context.Background(), c.Name(), ciphertext, decryptParams)
+}
+
+func (c AgeCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c AgeCrypter) decryptV1(ctx context.Context, b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	identities, err := ageIdentities()
+	if err != nil {
+		return "", err
+	}
+	return ageDecrypt(b64ciphertext, identities)
+}
+
+// ageEncrypt encrypts the plaintext to the recipients as a base64 encoded
+// binary age file.
+func ageEncrypt(plaintext string, recipients []age.Recipient) (Ciphertext, error) {
+	var ciphertext bytes.Buffer
+	writer, err := age.Encrypt(&ciphertext, recipients...)
+	if err != nil {
+		return Ciphertext(""), fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+	if _, err := writer.Write([]byte(plaintext)); err != nil {
+		return Ciphertext(""), fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		return Ciphertext(""), fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+	return Ciphertext(base64.StdEncoding.EncodeToString(ciphertext.Bytes())), nil
+}
+
+// ageDecrypt decrypts a ciphertext produced by ageEncrypt with the first
+// matching identity.
+func ageDecrypt(b64ciphertext Ciphertext, identities []age.Identity) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(string(b64ciphertext))
+	if err != nil {
+		return "", fmt.Errorf("Ciphertext is not valid base64 encoded in secret '%s'", b64ciphertext)
+	}
+	reader, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting secret: %s", err)
+	}
+	plaintext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting secret: %s", err)
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeAgeIdentityFile(t *testing.T, identities ...*age.X25519Identity) string {
+	identityFile, err := ioutil.TempFile("", "secretcrypt-age")
+	assert.NoError(t, err)
+	defer identityFile.Close()
+	_, err = identityFile.WriteString("# created: for tests\n")
+	assert.NoError(t, err)
+	for _, identity := range identities {
+		_, err = identityFile.WriteString(identity.String() + "\n")
+		assert.NoError(t, err)
+	}
+	return identityFile.Name()
+}
+
+func TestAge(t *testing.T) {
+	defer SetAgeIdentityFile("")
+	alice, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	eve, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	aliceFile := writeAgeIdentityFile(t, alice)
+	defer os.Remove(aliceFile)
+	bobFile := writeAgeIdentityFile(t, bob)
+	defer os.Remove(bobFile)
+	eveFile := writeAgeIdentityFile(t, eve)
+	defer os.Remove(eveFile)
+
+	ageCrypter := AgeCrypter{}
+	secret, decryptParams, err := ageCrypter.Encrypt("mypass", EncryptParams{
+		"recipients": alice.Recipient().String() + ", " + bob.Recipient().String(),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{"v": "1"}, decryptParams)
+
+	for _, identityFile := range []string{aliceFile, bobFile} {
+		SetAgeIdentityFile(identityFile)
+		plaintext, err := ageCrypter.Decrypt(secret, decryptParams)
+		assert.NoError(t, err)
+		assert.Equal(t, "mypass", plaintext)
+	}
+
+	SetAgeIdentityFile(eveFile)
+	_, err = ageCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret: no identity matched any of the recipients")
+
+	SetAgeIdentityFile(aliceFile)
+	tampered := []byte(secret)
+	tampered[len(tampered)-8] ^= 1
+	_, err = ageCrypter.Decrypt(Ciphertext(tampered), decryptParams)
+	assert.Error(t, err)
+}
+
+func TestAgeIdentityFileEnv(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	identityFile := writeAgeIdentityFile(t, identity)
+	defer os.Remove(identityFile)
+
+	ageCrypter := AgeCrypter{}
+	secret, decryptParams, err := ageCrypter.Encrypt("mypass", EncryptParams{
+		"recipients": identity.Recipient().String(),
+	})
+	assert.NoError(t, err)
+
+	_, err = ageCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "No age identity file, set SECRETCRYPT_AGE_IDENTITY_FILE or configure the identity file")
+
+	os.Setenv(AgeIdentityFileEnv, identityFile)
+	defer os.Unsetenv(AgeIdentityFileEnv)
+	plaintext, err := ageCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+}
+
+func TestAgeInvalidRecipients(t *testing.T) {
+	_, _, err := AgeCrypter{}.Encrypt("mypass", EncryptParams{})
+	assert.EqualError(t, err, "Missing recipients parameter!")
+
+	_, _, err = AgeCrypter{}.Encrypt("mypass", EncryptParams{"recipients": "age1notakey"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid age recipient 'age1notakey'")
+}
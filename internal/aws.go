@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// AWSConfig configures the AWS sessions used by AWS backed crypters.
+type AWSConfig struct {
+	// Session is used as the base session if set. Otherwise a session is
+	// created from the shared config files and the environment.
+	Session *session.Session
+	// Config is merged into the session's configuration.
+	Config *aws.Config
+	// Profile is the shared config profile to create the session from.
+	Profile string
+	// RoleARN is a role to assume with the session's credentials.
+	RoleARN string
+	// Endpoint overrides the endpoint URL of the service clients, but not of
+	// STS used to assume RoleARN.
+	Endpoint string
+	// HTTPClient overrides the HTTP client.
+	HTTPClient *http.Client
+}
+
+var awsConfigs = make(map[string]AWSConfig)
+var awsConfigsLock sync.RWMutex
+
+// SetAWSConfig sets the AWS configuration used for all regions that have no
+// region specific configuration.
+func SetAWSConfig(config AWSConfig) {
+	SetRegionAWSConfig("", config)
+}
+
+// SetRegionAWSConfig sets the AWS configuration used for the given region.
+func SetRegionAWSConfig(region string, config AWSConfig) {
+	awsConfigsLock.Lock()
+	awsConfigs[region] = config
+	awsConfigsLock.Unlock()
+	ResetKMSClients()
+	ResetSSMClients()
+}
+
+func regionAWSConfig(region string) AWSConfig {
+	awsConfigsLock.RLock()
+	defer awsConfigsLock.RUnlock()
+	if config, exists := awsConfigs[region]; exists {
+		return config
+	}
+	return awsConfigs[""]
+}
+
+// awsSession returns a session for the region configured by SetAWSConfig
+// and SetRegionAWSConfig, along with the configuration for service clients.
+func awsSession(region string) (*session.Session, *aws.Config, error) {
+	config := regionAWSConfig(region)
+
+	serviceConfig := aws.NewConfig().WithRegion(region)
+	if config.Endpoint != "" {
+		serviceConfig.WithEndpoint(config.Endpoint)
+	}
+
+	overrides := aws.NewConfig().WithRegion(region)
+	if config.HTTPClient != nil {
+		overrides.WithHTTPClient(config.HTTPClient)
+	}
+
+	var sess *session.Session
+	if config.Session != nil {
+		sess = config.Session.Copy(config.Config, overrides)
+	} else {
+		sessionConfig := aws.NewConfig()
+		if config.Config != nil {
+			sessionConfig.MergeIn(config.Config)
+		}
+		sessionConfig.MergeIn(overrides)
+
+		var err error
+		sess, err = session.NewSessionWithOptions(session.Options{
+			Config:            *sessionConfig,
+			Profile:           config.Profile,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if config.RoleARN != "" {
+		sess = sess.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(sess, config.RoleARN),
+		})
+	}
+	return sess, serviceConfig, nil
+}
+
+// awsConfiguredEndpoint returns the endpoint that service clients created from
+// the session and the service configuration use, or "" for the default
+// endpoint of the service. It may come from Endpoint, Config or Session of
+// the AWS configuration.
+func awsConfiguredEndpoint(sess *session.Session, serviceConfig *aws.Config) string {
+	if endpoint := aws.StringValue(serviceConfig.Endpoint); endpoint != "" {
+		return endpoint
+	}
+	return aws.StringValue(sess.Config.Endpoint)
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+)
+
+func resetAWSConfigs() {
+	awsConfigsLock.Lock()
+	awsConfigs = make(map[string]AWSConfig)
+	awsConfigsLock.Unlock()
+	ResetKMSClients()
+	ResetSSMClients()
+}
+
+func TestAWSConfig(t *testing.T) {
+	defer resetAWSConfigs()
+	httpClient := &http.Client{}
+	SetAWSConfig(AWSConfig{
+		Endpoint:   "http://localhost:4566",
+		HTTPClient: httpClient,
+		Config:     aws.NewConfig().WithMaxRetries(7),
+	})
+	SetRegionAWSConfig("eu-west-1", AWSConfig{
+		Endpoint: "http://localhost:4567",
+	})
+
+	client, err := kmsClient("us-east-1")
+	assert.NoError(t, err)
+	kmsService := client.(*kms.KMS)
+	assert.Equal(t, "http://localhost:4566", kmsService.Endpoint)
+	assert.Equal(t, "us-east-1", kmsService.SigningRegion)
+	assert.Equal(t, httpClient, kmsService.Config.HTTPClient)
+	assert.Equal(t, 7, aws.IntValue(kmsService.Config.MaxRetries))
+
+	client, err = kmsClient("eu-west-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:4567", client.(*kms.KMS).Endpoint)
+
+	// changing the configuration drops cached clients
+	SetAWSConfig(AWSConfig{Endpoint: "http://localhost:4568"})
+	client, err = kmsClient("us-east-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:4568", client.(*kms.KMS).Endpoint)
+}
+
+func TestKMSEndpointPrecedence(t *testing.T) {
+	defer resetAWSConfigs()
+	defer SetKMSEndpoint("")
+	os.Setenv(KMSEndpointEnv, "http://localhost:4566")
+	defer os.Unsetenv(KMSEndpointEnv)
+	kmsEndpoint := func() string {
+		client, err := kmsClient("us-east-1")
+		assert.NoError(t, err)
+		return client.(*kms.KMS).Endpoint
+	}
+
+	assert.Equal(t, "http://localhost:4566", kmsEndpoint())
+	SetAWSConfig(AWSConfig{Endpoint: "http://localhost:4567"})
+	assert.Equal(t, "http://localhost:4567", kmsEndpoint())
+	SetAWSConfig(AWSConfig{Config: aws.NewConfig().WithEndpoint("http://localhost:4568")})
+	assert.Equal(t, "http://localhost:4568", kmsEndpoint())
+	sess, err := session.NewSession(aws.NewConfig().WithEndpoint("http://localhost:4569"))
+	assert.NoError(t, err)
+	SetAWSConfig(AWSConfig{Session: sess})
+	assert.Equal(t, "http://localhost:4569", kmsEndpoint())
+	SetKMSEndpoint("http://localhost:4570")
+	assert.Equal(t, "http://localhost:4570", kmsEndpoint())
+}
+
+func TestSSMEndpointPrecedence(t *testing.T) {
+	defer resetAWSConfigs()
+	defer SetSSMEndpoint("")
+	os.Setenv(SSMEndpointEnv, "http://localhost:4566")
+	defer os.Unsetenv(SSMEndpointEnv)
+	ssmEndpoint := func() string {
+		client, err := ssmClient("us-east-1")
+		assert.NoError(t, err)
+		return client.(*ssm.SSM).Endpoint
+	}
+
+	assert.Equal(t, "http://localhost:4566", ssmEndpoint())
+	SetAWSConfig(AWSConfig{Endpoint: "http://localhost:4567"})
+	assert.Equal(t, "http://localhost:4567", ssmEndpoint())
+	sess, err := session.NewSession(aws.NewConfig().WithEndpoint("http://localhost:4568"))
+	assert.NoError(t, err)
+	SetAWSConfig(AWSConfig{Session: sess})
+	assert.Equal(t, "http://localhost:4568", ssmEndpoint())
+	SetSSMEndpoint("http://localhost:4569")
+	assert.Equal(t, "http://localhost:4569", ssmEndpoint())
+}
+
+func TestAWSConfigRoleARN(t *testing.T) {
+	defer resetAWSConfigs()
+	sess, _, err := awsSession("us-east-1")
+	assert.NoError(t, err)
+	defaultCredentials := sess.Config.Credentials
+
+	SetAWSConfig(AWSConfig{RoleARN: "arn:aws:iam::123456789012:role/MyRole"})
+	sess, _, err = awsSession("us-east-1")
+	assert.NoError(t, err)
+	assert.NotNil(t, sess.Config.Credentials)
+	assert.NotEqual(t, defaultCredentials, sess.Config.Credentials)
+}
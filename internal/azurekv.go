@@ -0,0 +1,331 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AzureKeyVaultCrypter envelope encrypts secrets: the plaintext is encrypted
+// locally with AES-256-GCM under a fresh data key, which is wrapped with an
+// Azure Key Vault key.
+type AzureKeyVaultCrypter struct{}
+
+const azureKeyVaultVersion = "1"
+
+const azureKeyVaultAPIVersion = "7.4"
+
+const defaultAzureKeyWrapAlgorithm = "RSA-OAEP-256"
+
+// azureKeyPathSegment matches key names and versions, so that those from
+// secrets cannot redirect requests to other Key Vault operations.
+var azureKeyPathSegment = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// AzureKeyVaultConfig configures how the azurekv crypter authenticates to
+// Azure Key Vault.
+type AzureKeyVaultConfig struct {
+	// TokenSource supplies access tokens for Key Vault. Defaults to the
+	// AZURE_ACCESS_TOKEN environment variable if set, otherwise to the
+	// managed identity of the Azure VM, AKS pod or container.
+	TokenSource AzureTokenSource
+	// HTTPClient overrides the HTTP client.
+	HTTPClient *http.Client
+	// AllowedVaults lists vault URLs, e.g. of an emulator, that are trusted
+	// with access tokens in addition to https vaults under the Azure Key
+	// Vault domains.
+	AllowedVaults []string
+}
+
+// azureKeyVaultDomains are the Key Vault DNS suffixes of the public and the
+// sovereign Azure clouds.
+var azureKeyVaultDomains = []string{
+	".vault.azure.net",
+	".vault.azure.cn",
+	".vault.usgovcloudapi.net",
+	".vault.microsoftazure.de",
+}
+
+// AzureTokenSource supplies access tokens for the Key Vault resource,
+// https://vault.azure.net. A zero expiry means the token is not cached.
+type AzureTokenSource interface {
+	Token(ctx context.Context) (string, time.Time, error)
+}
+
+// AzureStaticToken uses a fixed access token, e.g. from
+// `az account get-access-token --resource https://vault.azure.net`.
+type AzureStaticToken struct {
+	AccessToken string
+}
+
+func (s AzureStaticToken) Token(ctx context.Context) (string, time.Time, error) {
+	return s.AccessToken, time.Time{}, nil
+}
+
+const defaultAzureIMDSEndpoint = "http://169.254.169.254"
+
+const azureKeyVaultResource = "https://vault.azure.net"
+
+// AzureManagedIdentityTokenSource gets access tokens of a managed identity
+// from the Azure Instance Metadata Service.
+type AzureManagedIdentityTokenSource struct {
+	// ClientID selects a user-assigned identity. Defaults to the
+	// system-assigned identity.
+	ClientID string
+	// Endpoint overrides the Instance Metadata Service URL.
+	Endpoint string
+	// HTTPClient overrides the HTTP client.
+	HTTPClient *http.Client
+}
+
+func (s AzureManagedIdentityTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = defaultAzureIMDSEndpoint
+	}
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {azureKeyVaultResource},
+	}
+	if s.ClientID != "" {
+		query.Set("client_id", s.ClientID)
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		// the Instance Metadata Service returns it as a string
+		ExpiresIn string `json:"expires_in"`
+	}
+	var imdsErr struct {
+		Description string `json:"error_description"`
+	}
+	tokenURL := strings.TrimRight(endpoint, "/") + "/metadata/identity/oauth2/token?" + query.Encode()
+	header := http.Header{"Metadata": {"true"}}
+	status, err := sendJSON(ctx, s.HTTPClient, "GET", tokenURL, header, nil, &resp, &imdsErr)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Error getting token from Azure Instance Metadata Service: %s", err)
+	}
+	if status != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("Azure Instance Metadata Service error %d: %s", status, imdsErr.Description)
+	}
+	expiresIn, err := strconv.Atoi(resp.ExpiresIn)
+	if err != nil {
+		return resp.AccessToken, time.Time{}, nil
+	}
+	return resp.AccessToken, time.Now().Add(time.Duration(expiresIn) * time.Second), nil
+}
+
+// azureKeyVaultTokens holds the configuration and caches the access token.
+var azureKeyVaultTokens = &tokenCache{
+	fetch:          azureAccessToken,
+	rejectedStatus: http.StatusUnauthorized,
+	config:         AzureKeyVaultConfig{},
+}
+
+// SetAzureKeyVaultConfig sets how the azurekv crypter authenticates to Azure
+// Key Vault. A token cached for the previous configuration is dropped.
+func SetAzureKeyVaultConfig(config AzureKeyVaultConfig) {
+	azureKeyVaultTokens.setConfig(config)
+}
+
+func (c AzureKeyVaultCrypter) Name() string {
+	return "azurekv"
+}
+
+func (c AzureKeyVaultCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	vaultURL, ok := encryptParams["vault"]
+	if !ok {
+		return Ciphertext(""), nil, fmt.Errorf("Missing vault parameter!")
+	}
+	keyName, ok := encryptParams["key"]
+	if !ok {
+		return Ciphertext(""), nil, fmt.Errorf("Missing key parameter!")
+	}
+	algorithm := encryptParams["algorithm"]
+	if algorithm == "" {
+		algorithm = defaultAzureKeyWrapAlgorithm
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error generating data key: %s", err)
+	}
+	defer wipe(key)
+
+	var resp struct {
+		KeyID string `json:"kid"`
+		Value string `json:"value"`
+	}
+	keyPath, err := azureKeyPath(keyName, encryptParams["version"])
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+	err = azureKeyVaultCall(context.Background(), vaultURL, keyPath+"/wrapkey", map[string]string{
+		"alg":   algorithm,
+		"value": base64.RawURLEncoding.EncodeToString(key),
+	}, &resp)
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+
+	ciphertext, err := AESEncrypt(key, plaintext)
+	if err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+
+	// record the version that wrapped the key, so that rotating the key
+	// does not break the secret
+	version := encryptParams["version"]
+	if resp.KeyID != "" {
+		version = resp.KeyID[strings.LastIndex(resp.KeyID, "/")+1:]
+	}
+	decryptParams := DecryptParams{
+		"vault":   vaultURL,
+		"key":     keyName,
+		"version": version,
+		"alg":     algorithm,
+		"datakey": resp.Value,
+	}
+	return Ciphertext(ciphertext), withVersion(azureKeyVaultVersion, decryptParams), nil
+}
+
+func (c AzureKeyVaultCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.DecryptContext(context.Background(), ciphertext, decryptParams)
+}
+
+func (c AzureKeyVaultCrypter) DecryptContext(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(ctx, c.Name(), ciphertext, decryptParams)
+}
+
+func (c AzureKeyVaultCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c AzureKeyVaultCrypter) decryptV1(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	for _, param := range []string{"vault", "key", "version", "alg", "datakey"} {
+		if _, ok := decryptParams[param]; !ok {
+			return "", fmt.Errorf("Missing %s parameter!", param)
+		}
+	}
+
+	var resp struct {
+		Value string `json:"value"`
+	}
+	keyPath, err := azureKeyPath(decryptParams["key"], decryptParams["version"])
+	if err != nil {
+		return "", err
+	}
+	err = azureKeyVaultCall(ctx, decryptParams["vault"], keyPath+"/unwrapkey", map[string]string{
+		"alg":   decryptParams["alg"],
+		"value": decryptParams["datakey"],
+	}, &resp)
+	if err != nil {
+		return "", fmt.Errorf("Error unwrapping data key: %s", err)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(resp.Value, "="))
+	if err != nil {
+		return "", fmt.Errorf("Azure Key Vault returned an invalid data key: %s", err)
+	}
+	defer wipe(key)
+
+	plaintext, err := AESDecrypt(key, string(ciphertext))
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting secret: %s", err)
+	}
+	return plaintext, nil
+}
+
+// azureKeyPath returns the API path of a key version, or of the latest
+// version if version is empty.
+func azureKeyPath(keyName, version string) (string, error) {
+	if !azureKeyPathSegment.MatchString(keyName) {
+		return "", fmt.Errorf("Invalid key parameter '%s'", keyName)
+	}
+	if version == "" {
+		return "keys/" + keyName, nil
+	}
+	if !azureKeyPathSegment.MatchString(version) {
+		return "", fmt.Errorf("Invalid version parameter '%s'", version)
+	}
+	return "keys/" + keyName + "/" + version, nil
+}
+
+// checkAzureVaultURL makes sure that the vault URL, which secrets carry in
+// their decrypt params, points at Azure Key Vault before an access token is
+// sent to it.
+func checkAzureVaultURL(config AzureKeyVaultConfig, vaultURL string) error {
+	for _, allowed := range config.AllowedVaults {
+		if strings.TrimRight(allowed, "/") == strings.TrimRight(vaultURL, "/") {
+			return nil
+		}
+	}
+	u, err := url.Parse(vaultURL)
+	if err != nil {
+		return fmt.Errorf("Invalid Azure Key Vault URL '%s': %s", vaultURL, err)
+	}
+	if u.Scheme == "https" && u.User == nil && u.Port() == "" && strings.TrimRight(u.Path, "/") == "" &&
+		u.RawQuery == "" && u.Fragment == "" {
+		host := strings.ToLower(u.Hostname())
+		for _, domain := range azureKeyVaultDomains {
+			if strings.HasSuffix(host, domain) && len(host) > len(domain) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Untrusted Azure Key Vault URL '%s', expected https://<name>.vault.azure.net or a configured vault", vaultURL)
+}
+
+// azureKeyVaultCall posts to a Key Vault API path, fetching a new access
+// token once if Key Vault rejects the cached one.
+func azureKeyVaultCall(ctx context.Context, vaultURL, path string, req, out interface{}) error {
+	check := func(config interface{}) error {
+		return checkAzureVaultURL(config.(AzureKeyVaultConfig), vaultURL)
+	}
+	callURL := strings.TrimRight(vaultURL, "/") + "/" + path + "?api-version=" + azureKeyVaultAPIVersion
+	return azureKeyVaultTokens.call(ctx, check, func(config interface{}, token string) (int, error) {
+		var azureErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		header := http.Header{"Authorization": {"Bearer " + token}}
+		status, err := sendJSON(ctx, config.(AzureKeyVaultConfig).HTTPClient, "POST", callURL, header, req, out, &azureErr)
+		if err != nil {
+			return status, fmt.Errorf("Error calling Azure Key Vault: %s", err)
+		}
+		if status != http.StatusOK {
+			return status, fmt.Errorf("Azure Key Vault error %d on %s: %s: %s", status, path, azureErr.Error.Code, azureErr.Error.Message)
+		}
+		return status, nil
+	})
+}
+
+func azureAccessToken(ctx context.Context, c interface{}) (string, time.Time, error) {
+	config := c.(AzureKeyVaultConfig)
+	tokenSource := config.TokenSource
+	if tokenSource == nil {
+		if token := os.Getenv("AZURE_ACCESS_TOKEN"); token != "" {
+			tokenSource = AzureStaticToken{AccessToken: token}
+		} else {
+			tokenSource = AzureManagedIdentityTokenSource{HTTPClient: config.HTTPClient}
+		}
+	}
+	token, expiry, err := tokenSource.Token(ctx)
+	if err == nil && token == "" {
+		err = fmt.Errorf("Empty access token")
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Error getting Azure access token: %s", err)
+	}
+	return token, expiry, nil
+}
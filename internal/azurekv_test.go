@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAzureKeyVault is an in-process stand-in for the Azure Key Vault key
+// wrapping API and the token endpoint of the Instance Metadata Service. The
+// latest version of mykey is v2.
+type fakeAzureKeyVault struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	tokens      map[string]bool
+	wrappedKeys map[string]string
+	tokenIssued int
+	requests    int
+}
+
+func newFakeAzureKeyVault() *fakeAzureKeyVault {
+	f := &fakeAzureKeyVault{
+		tokens:      map[string]bool{"mytoken": true},
+		wrappedKeys: make(map[string]string),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeAzureKeyVault) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.URL.Path == "/metadata/identity/oauth2/token" {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != azureKeyVaultResource {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"error_description": "bad request"})
+			return
+		}
+		f.tokenIssued++
+		token := fmt.Sprintf("imds-token%d", f.tokenIssued)
+		f.tokens[token] = true
+		respondJSON(w, http.StatusOK, map[string]string{"access_token": token, "expires_in": "86399"})
+		return
+	}
+
+	f.requests++
+	if !f.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		f.fail(w, http.StatusUnauthorized, "Unauthorized", "AKV10000: Request is missing a Bearer or PoP token.")
+		return
+	}
+	if r.URL.Query().Get("api-version") != azureKeyVaultAPIVersion {
+		f.fail(w, http.StatusBadRequest, "BadParameter", "unsupported api-version")
+		return
+	}
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.fail(w, http.StatusBadRequest, "BadParameter", err.Error())
+		return
+	}
+
+	tokens := strings.Split(strings.TrimPrefix(r.URL.Path, "/keys/"), "/")
+	operation := tokens[len(tokens)-1]
+	version := "v2"
+	if len(tokens) == 3 {
+		version = tokens[1]
+	}
+	if tokens[0] != "mykey" || (version != "v1" && version != "v2") || len(tokens) > 3 {
+		f.fail(w, http.StatusNotFound, "KeyNotFound", "A key with (name/id) was not found in this key vault.")
+		return
+	}
+	kid := f.URL + "/keys/mykey/" + version
+
+	switch operation {
+	case "wrapkey":
+		wrappedKey := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%s-%d", version, req["alg"], len(f.wrappedKeys))))
+		f.wrappedKeys[wrappedKey] = req["value"]
+		respondJSON(w, http.StatusOK, map[string]string{"kid": kid, "value": wrappedKey})
+	case "unwrapkey":
+		key, exists := f.wrappedKeys[req["value"]]
+		wrappedBy, _ := base64.RawURLEncoding.DecodeString(req["value"])
+		if !exists || !strings.HasPrefix(string(wrappedBy), version+"-"+req["alg"]+"-") {
+			f.fail(w, http.StatusBadRequest, "BadParameter", "Error unwrapping key")
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{"kid": kid, "value": key})
+	default:
+		f.fail(w, http.StatusNotFound, "NotFound", operation)
+	}
+}
+
+func (f *fakeAzureKeyVault) requestCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *fakeAzureKeyVault) revokeTokens() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tokens = make(map[string]bool)
+}
+
+func (f *fakeAzureKeyVault) fail(w http.ResponseWriter, status int, code, message string) {
+	respondJSON(w, status, map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
+
+func TestAzureKeyVault(t *testing.T) {
+	fake := newFakeAzureKeyVault()
+	defer fake.Close()
+	defer SetAzureKeyVaultConfig(AzureKeyVaultConfig{})
+	SetAzureKeyVaultConfig(AzureKeyVaultConfig{
+		TokenSource:   AzureStaticToken{AccessToken: "mytoken"},
+		AllowedVaults: []string{fake.URL},
+	})
+
+	azureCrypter := AzureKeyVaultCrypter{}
+	secret, decryptParams, err := azureCrypter.Encrypt("mypass", EncryptParams{
+		"vault": fake.URL,
+		"key":   "mykey",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, fake.URL, decryptParams["vault"])
+	assert.Equal(t, "mykey", decryptParams["key"])
+	assert.Equal(t, "v2", decryptParams["version"], "latest version is recorded")
+	assert.Equal(t, "RSA-OAEP-256", decryptParams["alg"])
+	assert.NotEmpty(t, decryptParams["datakey"])
+	assert.Equal(t, "1", decryptParams["v"])
+	assert.NotContains(t, string(secret), "mypass")
+
+	plaintext, err := azureCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	plaintext, err = azureCrypter.DecryptContext(ctx, secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	decryptParams["version"] = "v1"
+	_, err = azureCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error unwrapping data key: Azure Key Vault error 400 on keys/mykey/v1/unwrapkey: BadParameter: Error unwrapping key")
+
+	delete(decryptParams, "datakey")
+	_, err = azureCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Missing datakey parameter!")
+
+	_, _, err = azureCrypter.Encrypt("mypass", EncryptParams{"vault": fake.URL})
+	assert.EqualError(t, err, "Missing key parameter!")
+}
+
+func TestAzureKeyVaultKeyVersion(t *testing.T) {
+	fake := newFakeAzureKeyVault()
+	defer fake.Close()
+	defer SetAzureKeyVaultConfig(AzureKeyVaultConfig{})
+	SetAzureKeyVaultConfig(AzureKeyVaultConfig{
+		TokenSource:   AzureStaticToken{AccessToken: "mytoken"},
+		AllowedVaults: []string{fake.URL},
+	})
+
+	azureCrypter := AzureKeyVaultCrypter{}
+	secret, decryptParams, err := azureCrypter.Encrypt("mypass", EncryptParams{
+		"vault":     fake.URL,
+		"key":       "mykey",
+		"version":   "v1",
+		"algorithm": "RSA1_5",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", decryptParams["version"])
+	assert.Equal(t, "RSA1_5", decryptParams["alg"])
+
+	plaintext, err := azureCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+}
+
+func TestAzureKeyVaultManagedIdentity(t *testing.T) {
+	fake := newFakeAzureKeyVault()
+	defer fake.Close()
+	defer SetAzureKeyVaultConfig(AzureKeyVaultConfig{})
+	SetAzureKeyVaultConfig(AzureKeyVaultConfig{
+		TokenSource:   AzureManagedIdentityTokenSource{Endpoint: fake.URL},
+		AllowedVaults: []string{fake.URL},
+	})
+
+	azureCrypter := AzureKeyVaultCrypter{}
+	secret, decryptParams, err := azureCrypter.Encrypt("mypass", EncryptParams{
+		"vault": fake.URL,
+		"key":   "mykey",
+	})
+	assert.NoError(t, err)
+	plaintext, err := azureCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, 1, fake.tokenIssued, "token is cached until it expires")
+
+	// a revoked token is replaced
+	fake.revokeTokens()
+	plaintext, err = azureCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, 2, fake.tokenIssued)
+}
+
+func TestAzureKeyVaultUntrustedVault(t *testing.T) {
+	fake := newFakeAzureKeyVault()
+	defer fake.Close()
+	defer SetAzureKeyVaultConfig(AzureKeyVaultConfig{})
+	SetAzureKeyVaultConfig(AzureKeyVaultConfig{
+		TokenSource:   AzureManagedIdentityTokenSource{Endpoint: fake.URL},
+		AllowedVaults: []string{fake.URL},
+	})
+
+	azureCrypter := AzureKeyVaultCrypter{}
+	secret, decryptParams, err := azureCrypter.Encrypt("mypass", EncryptParams{
+		"vault": fake.URL,
+		"key":   "mykey",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fake.tokenIssued)
+
+	for _, vaultURL := range []string{
+		"http://attacker.example",
+		"https://attacker.example",
+		"http://myvault.vault.azure.net",
+		"https://myvault.vault.azure.net.attacker.example",
+		"https://myvault.vault.azure.net:8443",
+		"https://user@myvault.vault.azure.net",
+		"https://myvault.vault.azure.net/evil?x=",
+		"https://.vault.azure.net",
+	} {
+		SetAzureKeyVaultConfig(AzureKeyVaultConfig{
+			TokenSource:   AzureManagedIdentityTokenSource{Endpoint: fake.URL},
+			AllowedVaults: []string{fake.URL},
+		})
+		decryptParams["vault"] = vaultURL
+		_, err := azureCrypter.Decrypt(secret, decryptParams)
+		assert.Error(t, err, vaultURL)
+		assert.Contains(t, err.Error(), "Untrusted Azure Key Vault URL", vaultURL)
+	}
+	assert.Equal(t, 1, fake.tokenIssued, "no token is fetched for untrusted vaults")
+
+	config := AzureKeyVaultConfig{}
+	for _, vaultURL := range []string{"https://myvault.vault.azure.net", "https://myvault.vault.azure.cn/", "https://MyVault.vault.usgovcloudapi.net"} {
+		assert.NoError(t, checkAzureVaultURL(config, vaultURL), vaultURL)
+	}
+}
+
+func TestAzureKeyVaultInvalidKeyPaths(t *testing.T) {
+	fake := newFakeAzureKeyVault()
+	defer fake.Close()
+	defer SetAzureKeyVaultConfig(AzureKeyVaultConfig{})
+	SetAzureKeyVaultConfig(AzureKeyVaultConfig{
+		TokenSource:   AzureStaticToken{AccessToken: "mytoken"},
+		AllowedVaults: []string{fake.URL},
+	})
+
+	azureCrypter := AzureKeyVaultCrypter{}
+	for _, tc := range []struct {
+		key     string
+		version string
+		err     string
+	}{
+		{"victim/rotate?", "v1", "Invalid key parameter 'victim/rotate?'"},
+		{"mykey/v1", "", "Invalid key parameter 'mykey/v1'"},
+		{"..", "v1", "Invalid key parameter '..'"},
+		{"mykey#", "v1", "Invalid key parameter 'mykey#'"},
+		{"", "v1", "Invalid key parameter ''"},
+		{"mykey", "v1/rotate?", "Invalid version parameter 'v1/rotate?'"},
+		{"mykey", "..", "Invalid version parameter '..'"},
+		{"mykey", "v1%2Frotate", "Invalid version parameter 'v1%2Frotate'"},
+	} {
+		_, err := azureCrypter.Decrypt("gcm1.AAAA", DecryptParams{
+			"vault":   fake.URL,
+			"key":     tc.key,
+			"version": tc.version,
+			"alg":     defaultAzureKeyWrapAlgorithm,
+			"datakey": "AAAA",
+			"v":       "1",
+		})
+		assert.EqualError(t, err, tc.err)
+		_, _, err = azureCrypter.Encrypt("mypass", EncryptParams{"vault": fake.URL, "key": tc.key, "version": tc.version})
+		assert.EqualError(t, err, tc.err)
+	}
+	assert.Equal(t, 0, fake.requestCount())
+}
@@ -1,65 +1,148 @@
 package internal
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
 )
 
+// aesGCMPrefix marks ciphertexts in the authenticated AES-256-GCM format.
+// Legacy AES-CBC ciphertexts are plain standard base64 and can never start
+// with it.
+const aesGCMPrefix = "gcm1."
+
+// aesGCMKeyInfo separates the AES-256-GCM key derived from the crypter key
+// from any other use of that key.
+const aesGCMKeyInfo = "secretcrypt aes-256-gcm"
+
+// ErrCiphertextAuthentication is returned when a ciphertext has been tampered
+// with or was encrypted with a different key.
+var ErrCiphertextAuthentication = errors.New("Ciphertext failed authentication")
+
+// AESEncrypt encrypts the plaintext with AES-256-GCM, using a key derived from
+// the given key, and returns the versioned base64 encoded ciphertext.
 func AESEncrypt(key []byte, plaintext string) (string, error) {
-	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
-	padtext := string(bytes.Repeat([]byte{byte(padding)}, padding))
-	plaintext = plaintext + padtext
+	gcm, err := newAESGCM(key)
+	if err != nil {
+		return "", err
+	}
 
-	block, err := aes.NewCipher(key)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("Error initializing nonce: %s", err)
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(aesGCMPrefix))
+	return aesGCMPrefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// AESDecrypt decrypts a ciphertext produced by AESEncrypt.
+func AESDecrypt(key []byte, ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, aesGCMPrefix) {
+		return "", fmt.Errorf("Ciphertext is not in the AES-GCM format")
+	}
+	return aesGCMDecrypt(key, strings.TrimPrefix(ciphertext, aesGCMPrefix))
+}
+
+// AESDecryptLegacy decrypts a legacy unauthenticated AES-CBC ciphertext, as
+// written before secrets recorded their format version.
+func AESDecryptLegacy(key []byte, ciphertext string) (string, error) {
+	return aesCBCDecrypt(key, ciphertext)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("Error creating AES cipher: empty key")
+	}
+	derivedKey := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, key, nil, []byte(aesGCMKeyInfo))
+	if _, err := io.ReadFull(kdf, derivedKey); err != nil {
+		return nil, fmt.Errorf("Error deriving AES key: %s", err)
+	}
+
+	block, err := aes.NewCipher(derivedKey)
 	if err != nil {
-		return "", fmt.Errorf("Error creating AES cipher: %s", err)
+		return nil, fmt.Errorf("Error creating AES cipher: %s", err)
 	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating AES-GCM cipher: %s", err)
+	}
+	return gcm, nil
+}
 
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", fmt.Errorf("Error initializing IV: %s", err)
+func aesGCMDecrypt(key []byte, b64ciphertext string) (string, error) {
+	gcm, err := newAESGCM(key)
+	if err != nil {
+		return "", err
 	}
 
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext[aes.BlockSize:], []byte(plaintext))
+	ciphertext, err := base64.StdEncoding.DecodeString(b64ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("Ciphertext is not valid base64 encoded in secret '%s'", b64ciphertext)
+	}
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return "", fmt.Errorf("Ciphertext too short in secret '%s'", b64ciphertext)
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	ciphertext = ciphertext[gcm.NonceSize():]
 
-	b64Ciphertext := base64.StdEncoding.EncodeToString(ciphertext)
-	return b64Ciphertext, nil
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(aesGCMPrefix))
+	if err != nil {
+		return "", ErrCiphertextAuthentication
+	}
+	return string(plaintext), nil
 }
 
-func AESDecrypt(key []byte, b64ciphertext string) (string, error) {
+func aesCBCDecrypt(key []byte, b64ciphertext string) (string, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return "", fmt.Errorf("Error creating AES cipher: %s", err)
 	}
 
-	ciphertext, err := base64.StdEncoding.DecodeString(string(b64ciphertext))
+	ciphertext, err := base64.StdEncoding.DecodeString(b64ciphertext)
 	if err != nil {
 		return "", fmt.Errorf("Ciphertext is not valid base64 encoded in secret '%s'", b64ciphertext)
 	}
-	if len(ciphertext) < aes.BlockSize {
-		return "", fmt.Errorf("Ciphertext too short in secret '%s'", ciphertext)
+	if len(ciphertext) < 2*aes.BlockSize {
+		return "", fmt.Errorf("Ciphertext too short in secret '%s'", b64ciphertext)
 	}
-	iv := []byte(ciphertext[:aes.BlockSize])
+	iv := ciphertext[:aes.BlockSize]
 	ciphertext = ciphertext[aes.BlockSize:]
 
 	if len(ciphertext)%aes.BlockSize != 0 {
-		return "", fmt.Errorf("Ciphertext is not a multiple of the block size in secret '%s'", ciphertext)
+		return "", fmt.Errorf("Ciphertext is not a multiple of the block size in secret '%s'", b64ciphertext)
 	}
 
 	mode := cipher.NewCBCDecrypter(block, iv)
 
 	plaintext := make([]byte, len(ciphertext))
-	mode.CryptBlocks(plaintext, []byte(ciphertext))
+	mode.CryptBlocks(plaintext, ciphertext)
 
 	length := len(plaintext)
 	unpadding := int(plaintext[length-1])
-	plaintext = plaintext[:(length - unpadding)]
-	return string(plaintext), nil
+	if unpadding == 0 || unpadding > aes.BlockSize {
+		return "", fmt.Errorf("Invalid padding in secret '%s'", b64ciphertext)
+	}
+	for _, padByte := range plaintext[length-unpadding:] {
+		if int(padByte) != unpadding {
+			return "", fmt.Errorf("Invalid padding in secret '%s'", b64ciphertext)
+		}
+	}
+	return string(plaintext[:length-unpadding]), nil
+}
+
+// wipe overwrites key material that is no longer needed.
+func wipe(key []byte) {
+	for i := range key {
+		key[i] = 0
+	}
 }
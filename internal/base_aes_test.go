@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"strings"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -16,3 +17,87 @@ func TestEncryptDecrypt(t *testing.T) {
 	plaintext, _ := AESDecrypt([]byte(keyB64), ciphertext)
 	assert.Equal(t, "mypass", plaintext)
 }
+
+func TestEncryptIsGCM(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	ciphertext, err := AESEncrypt(key, "mypass")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(ciphertext, aesGCMPrefix))
+
+	ciphertext2, err := AESEncrypt(key, "mypass")
+	assert.NoError(t, err)
+	assert.NotEqual(t, ciphertext, ciphertext2, "nonce must be random")
+}
+
+func TestDecryptLegacyCBC(t *testing.T) {
+	plaintext, err := AESDecryptLegacy(
+		[]byte("0123456789abcdef"),
+		"JR4iKxJl54dRP1lp71xAONWBn5+D1k7AKt641ufX37E=",
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	plaintext, err = AESDecryptLegacy(
+		[]byte("0123456789abcdef01234567"),
+		"yQrhHv08qbUY8nc1POFszJmel0gMotFYH2k/GFeRb1Q4yMgFhJfmJK+g41Wvy6/MmGSJgZYJlh21Taz2cP5RlA==",
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "a legacy secret longer than a block", plaintext)
+}
+
+func TestDecryptLegacyCBCInvalidPadding(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	legacy := "JR4iKxJl54dRP1lp71xAONWBn5+D1k7AKt641ufX37E="
+
+	// the last IV byte is XORed into the padding byte of the only block
+	ciphertext, _ := base64.StdEncoding.DecodeString(legacy)
+	for i := 0; i < 256; i++ {
+		ciphertext[15] = byte(i)
+		assert.NotPanics(t, func() {
+			_, _ = AESDecryptLegacy(key, base64.StdEncoding.EncodeToString(ciphertext))
+		})
+	}
+
+	// turn the valid padding byte 10 into 32
+	ciphertext, _ = base64.StdEncoding.DecodeString(legacy)
+	ciphertext[15] ^= 10 ^ 32
+	plaintext, err := AESDecryptLegacy(key, base64.StdEncoding.EncodeToString(ciphertext))
+	assert.Error(t, err)
+	assert.Zero(t, plaintext)
+}
+
+func TestDecryptFormats(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	ciphertext, err := AESEncrypt(key, "mypass")
+	assert.NoError(t, err)
+
+	// the format version of a secret determines the algorithm, so neither
+	// decryption falls back to the other
+	_, err = AESDecrypt(key, "JR4iKxJl54dRP1lp71xAONWBn5+D1k7AKt641ufX37E=")
+	assert.EqualError(t, err, "Ciphertext is not in the AES-GCM format")
+	_, err = AESDecryptLegacy(key, ciphertext)
+	assert.Error(t, err)
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	ciphertext, err := AESEncrypt(key, "mypass")
+	assert.NoError(t, err)
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, aesGCMPrefix))
+	assert.NoError(t, err)
+	raw[len(raw)-1] ^= 0x01
+	tampered := aesGCMPrefix + base64.StdEncoding.EncodeToString(raw)
+
+	plaintext, err := AESDecrypt(key, tampered)
+	assert.Equal(t, ErrCiphertextAuthentication, err)
+	assert.Zero(t, plaintext)
+
+	plaintext, err = AESDecrypt([]byte("fedcba9876543210"), ciphertext)
+	assert.Equal(t, ErrCiphertextAuthentication, err, "wrong key")
+	assert.Zero(t, plaintext)
+
+	plaintext, err = AESDecrypt(key, aesGCMPrefix+"Zm9v")
+	assert.Error(t, err, "too short")
+	assert.Zero(t, plaintext)
+}
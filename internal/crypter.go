@@ -1,14 +1,30 @@
 package internal
 
-var crypters = []Crypter{
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var builtinCrypters = []Crypter{
 	KMSCrypter{},
 	LocalCrypter{},
 	PlainCrypter{},
 	PasswordCrypter{},
+	VaultCrypter{},
+	GCPKMSCrypter{},
+	AzureKeyVaultCrypter{},
+	AgeCrypter{},
+	PGPCrypter{},
+	SSHCrypter{},
+	MultiCrypter{},
+	ShamirCrypter{},
+	SSMCrypter{},
 }
 
-// CryptersMap contains a mapping to supported crypters
-var CryptersMap map[string]Crypter
+var crypters = make(map[string]Crypter)
+var cryptersLock sync.RWMutex
 
 // Ciphertext is the encrypted plaintext
 type Ciphertext string
@@ -26,9 +42,93 @@ type Crypter interface {
 	Decrypt(Ciphertext, DecryptParams) (string, error)
 }
 
+// ContextCrypter is a Crypter whose decryption can be bounded and cancelled
+// with a context.
+type ContextCrypter interface {
+	Crypter
+	DecryptContext(context.Context, Ciphertext, DecryptParams) (string, error)
+}
+
+// DecryptContext decrypts the ciphertext with the given crypter, honouring
+// ctx. Crypters that do not implement ContextCrypter are run in a separate
+// goroutine whose result is abandoned if ctx is done first.
+func DecryptContext(ctx context.Context, crypter Crypter, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	if contextCrypter, ok := crypter.(ContextCrypter); ok {
+		return contextCrypter.DecryptContext(ctx, ciphertext, decryptParams)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	type result struct {
+		plaintext string
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		plaintext, err := crypter.Decrypt(ciphertext, decryptParams)
+		done <- result{plaintext, err}
+	}()
+	select {
+	case res := <-done:
+		return res.plaintext, res.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// RegisterCrypter makes a crypter available under the given name. It returns
+// an error if the name is invalid or already taken.
+func RegisterCrypter(name string, crypter Crypter) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("Invalid crypter name '%s'", name)
+	}
+	if crypter == nil {
+		return fmt.Errorf("Crypter '%s' is nil", name)
+	}
+
+	cryptersLock.Lock()
+	defer cryptersLock.Unlock()
+	if _, exists := crypters[name]; exists {
+		return fmt.Errorf("Crypter '%s' is already registered", name)
+	}
+	crypters[name] = crypter
+	return nil
+}
+
+// UnregisterCrypter removes the crypter registered under the given name and
+// reports whether it was registered.
+func UnregisterCrypter(name string) bool {
+	cryptersLock.Lock()
+	defer cryptersLock.Unlock()
+	_, exists := crypters[name]
+	delete(crypters, name)
+	return exists
+}
+
+// GetCrypter returns the crypter registered under the given name.
+func GetCrypter(name string) (Crypter, bool) {
+	cryptersLock.RLock()
+	defer cryptersLock.RUnlock()
+	crypter, exists := crypters[name]
+	return crypter, exists
+}
+
+// Crypters returns a snapshot of all registered crypters keyed by name.
+func Crypters() map[string]Crypter {
+	cryptersLock.RLock()
+	defer cryptersLock.RUnlock()
+	snapshot := make(map[string]Crypter, len(crypters))
+	for name, crypter := range crypters {
+		snapshot[name] = crypter
+	}
+	return snapshot
+}
+
 func init() {
-	CryptersMap = make(map[string]Crypter)
-	for _, crypter := range crypters {
-		CryptersMap[crypter.Name()] = crypter
+	for _, crypter := range builtinCrypters {
+		if err := RegisterCrypter(crypter.Name(), crypter); err != nil {
+			panic(err)
+		}
 	}
 }
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// GCPKMSCrypter encrypts secrets with Google Cloud KMS.
+type GCPKMSCrypter struct{}
+
+const gcpKMSVersion = "1"
+
+const defaultGCPKMSEndpoint = "https://cloudkms.googleapis.com"
+
+// gcpKMSKeyName matches the resource name of a crypto key, so that key names
+// from secrets cannot redirect requests to other resources or methods.
+var gcpKMSKeyName = regexp.MustCompile(`^projects/[^/?#:%]+/locations/[^/?#:%]+/keyRings/[^/?#:%]+/cryptoKeys/[^/?#:%]+$`)
+
+// checkGCPKMSKey checks that the key is the resource name of a crypto key.
+func checkGCPKMSKey(key string) error {
+	if !gcpKMSKeyName.MatchString(key) {
+		return fmt.Errorf("Invalid key parameter '%s'", key)
+	}
+	return nil
+}
+
+// GCPKMSEndpointEnv names the environment variable overriding the Cloud KMS
+// endpoint, e.g. to use a local emulator.
+const GCPKMSEndpointEnv = "SECRETCRYPT_GCPKMS_ENDPOINT"
+
+// GCPKMSConfig configures how the gcpkms crypter reaches and authenticates to
+// Cloud KMS.
+type GCPKMSConfig struct {
+	// Endpoint overrides the Cloud KMS endpoint URL. Defaults to the
+	// SECRETCRYPT_GCPKMS_ENDPOINT environment variable, then to the public
+	// endpoint.
+	Endpoint string
+	// TokenSource supplies OAuth2 access tokens. Defaults to the
+	// GOOGLE_OAUTH_ACCESS_TOKEN environment variable if set, otherwise to the
+	// GCE metadata server.
+	TokenSource GCPTokenSource
+	// HTTPClient overrides the HTTP client.
+	HTTPClient *http.Client
+}
+
+// GCPTokenSource supplies OAuth2 access tokens for Google Cloud APIs. A zero
+// expiry means the token is not cached.
+type GCPTokenSource interface {
+	Token(ctx context.Context) (string, time.Time, error)
+}
+
+// GCPStaticToken uses a fixed access token, e.g. from
+// `gcloud auth print-access-token`.
+type GCPStaticToken struct {
+	AccessToken string
+}
+
+func (s GCPStaticToken) Token(ctx context.Context) (string, time.Time, error) {
+	return s.AccessToken, time.Time{}, nil
+}
+
+const defaultGCEMetadataHost = "metadata.google.internal"
+
+// GCPMetadataTokenSource gets access tokens of the default service account
+// from the GCE metadata server, as available on GCE, GKE and Cloud Run.
+type GCPMetadataTokenSource struct {
+	// Host is the metadata server host. Defaults to the GCE_METADATA_HOST
+	// environment variable, then to metadata.google.internal.
+	Host string
+	// HTTPClient overrides the HTTP client.
+	HTTPClient *http.Client
+}
+
+func (s GCPMetadataTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	host := s.Host
+	if host == "" {
+		host = os.Getenv("GCE_METADATA_HOST")
+	}
+	if host == "" {
+		host = defaultGCEMetadataHost
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	url := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token"
+	header := http.Header{"Metadata-Flavor": {"Google"}}
+	status, err := sendJSON(ctx, s.HTTPClient, "GET", url, header, nil, &resp, &struct{}{})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Error getting token from GCE metadata server: %s", err)
+	}
+	if status != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("GCE metadata server error %d", status)
+	}
+	return resp.AccessToken, time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second), nil
+}
+
+// gcpKMSTokens holds the configuration and caches the access token.
+var gcpKMSTokens = &tokenCache{
+	fetch:          gcpAccessToken,
+	rejectedStatus: http.StatusUnauthorized,
+	config:         GCPKMSConfig{},
+}
+
+// SetGCPKMSConfig sets how the gcpkms crypter reaches and authenticates to
+// Cloud KMS. A token cached for the previous configuration is dropped.
+func SetGCPKMSConfig(config GCPKMSConfig) {
+	gcpKMSTokens.setConfig(config)
+}
+
+func (c GCPKMSCrypter) Name() string {
+	return "gcpkms"
+}
+
+func (c GCPKMSCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	key, ok := encryptParams["key"]
+	if !ok {
+		return Ciphertext(""), nil, fmt.Errorf("Missing key parameter!")
+	}
+	if err := checkGCPKMSKey(key); err != nil {
+		return Ciphertext(""), nil, err
+	}
+	decryptParams := DecryptParams{"key": key}
+	encryptionContext := encryptionContextParams(encryptParams)
+	for name, value := range encryptionContext {
+		decryptParams[name] = value
+	}
+
+	req := map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte(plaintext)),
+	}
+	if len(encryptionContext) > 0 {
+		req["additionalAuthenticatedData"] = gcpAdditionalAuthenticatedData(encryptionContext)
+	}
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := gcpKMSCall(context.Background(), key+":encrypt", req, &resp); err != nil {
+		return Ciphertext(""), nil, err
+	}
+	return Ciphertext(resp.Ciphertext), withVersion(gcpKMSVersion, decryptParams), nil
+}
+
+func (c GCPKMSCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.DecryptContext(context.Background(), ciphertext, decryptParams)
+}
+
+func (c GCPKMSCrypter) DecryptContext(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(ctx, c.Name(), ciphertext, decryptParams)
+}
+
+func (c GCPKMSCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c GCPKMSCrypter) decryptV1(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	key, ok := decryptParams["key"]
+	if !ok {
+		return "", fmt.Errorf("Missing key parameter!")
+	}
+	if err := checkGCPKMSKey(key); err != nil {
+		return "", err
+	}
+
+	req := map[string]string{
+		"ciphertext": string(ciphertext),
+	}
+	if encryptionContext := encryptionContextParams(decryptParams); len(encryptionContext) > 0 {
+		req["additionalAuthenticatedData"] = gcpAdditionalAuthenticatedData(encryptionContext)
+	}
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := gcpKMSCall(ctx, key+":decrypt", req, &resp); err != nil {
+		return "", err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return "", fmt.Errorf("Cloud KMS returned invalid plaintext: %s", err)
+	}
+	return string(plaintext), nil
+}
+
+// gcpAdditionalAuthenticatedData binds the ciphertext to the encryption
+// context params, encoded in a canonical order.
+func gcpAdditionalAuthenticatedData(encryptionContext map[string]string) string {
+	return base64.StdEncoding.EncodeToString([]byte(UnparseDecryptParams(encryptionContext)))
+}
+
+// gcpKMSCall calls a Cloud KMS method on a key resource, fetching a new
+// access token once if Cloud KMS rejects the cached one.
+func gcpKMSCall(ctx context.Context, method string, req, out interface{}) error {
+	return gcpKMSTokens.call(ctx, nil, func(c interface{}, token string) (int, error) {
+		config := c.(GCPKMSConfig)
+		endpoint := config.Endpoint
+		if endpoint == "" {
+			endpoint = os.Getenv(GCPKMSEndpointEnv)
+		}
+		if endpoint == "" {
+			endpoint = defaultGCPKMSEndpoint
+		}
+		url := strings.TrimRight(endpoint, "/") + "/v1/" + method
+
+		var gcpErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		header := http.Header{"Authorization": {"Bearer " + token}}
+		status, err := sendJSON(ctx, config.HTTPClient, "POST", url, header, req, out, &gcpErr)
+		if err != nil {
+			return status, fmt.Errorf("Error calling Cloud KMS: %s", err)
+		}
+		if status != http.StatusOK {
+			return status, fmt.Errorf("Cloud KMS error %d on %s: %s", status, method, gcpErr.Error.Message)
+		}
+		return status, nil
+	})
+}
+
+func gcpAccessToken(ctx context.Context, c interface{}) (string, time.Time, error) {
+	config := c.(GCPKMSConfig)
+	tokenSource := config.TokenSource
+	if tokenSource == nil {
+		if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+			tokenSource = GCPStaticToken{AccessToken: token}
+		} else {
+			tokenSource = GCPMetadataTokenSource{HTTPClient: config.HTTPClient}
+		}
+	}
+	token, expiry, err := tokenSource.Token(ctx)
+	if err == nil && token == "" {
+		err = fmt.Errorf("Empty access token")
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Error getting Google Cloud access token: %s", err)
+	}
+	return token, expiry, nil
+}
@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testGCPKey = "projects/myproject/locations/global/keyRings/myring/cryptoKeys/mykey"
+
+// fakeGCPKMS is an in-process stand-in for the Cloud KMS REST API and the
+// token endpoint of the GCE metadata server.
+type fakeGCPKMS struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	tokens      map[string]bool
+	blobs       map[string]fakeGCPKMSBlob
+	tokenIssued int
+	requests    int
+}
+
+type fakeGCPKMSBlob struct {
+	plaintext string
+	aad       string
+}
+
+func newFakeGCPKMS() *fakeGCPKMS {
+	f := &fakeGCPKMS{
+		tokens: map[string]bool{"mytoken": true},
+		blobs:  make(map[string]fakeGCPKMSBlob),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeGCPKMS) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			f.fail(w, http.StatusForbidden, "missing Metadata-Flavor header")
+			return
+		}
+		f.tokenIssued++
+		token := fmt.Sprintf("metadata-token%d", f.tokenIssued)
+		f.tokens[token] = true
+		respondJSON(w, http.StatusOK, map[string]interface{}{"access_token": token, "expires_in": 3599, "token_type": "Bearer"})
+		return
+	}
+
+	f.requests++
+	if !f.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		f.fail(w, http.StatusUnauthorized, "Request had invalid authentication credentials.")
+		return
+	}
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.fail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/" + testGCPKey + ":encrypt":
+		ciphertext := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("blob%d", len(f.blobs))))
+		f.blobs[ciphertext] = fakeGCPKMSBlob{req["plaintext"], req["additionalAuthenticatedData"]}
+		respondJSON(w, http.StatusOK, map[string]string{"name": testGCPKey + "/cryptoKeyVersions/1", "ciphertext": ciphertext})
+	case "/v1/" + testGCPKey + ":decrypt":
+		blob, exists := f.blobs[req["ciphertext"]]
+		if !exists || blob.aad != req["additionalAuthenticatedData"] {
+			f.fail(w, http.StatusBadRequest, "Decryption failed: the ciphertext is invalid.")
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{"plaintext": blob.plaintext})
+	default:
+		f.fail(w, http.StatusNotFound, "CryptoKey not found.")
+	}
+}
+
+func (f *fakeGCPKMS) requestCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *fakeGCPKMS) revokeTokens() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tokens = make(map[string]bool)
+}
+
+func (f *fakeGCPKMS) fail(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message},
+	})
+}
+
+func TestGCPKMS(t *testing.T) {
+	fake := newFakeGCPKMS()
+	defer fake.Close()
+	defer SetGCPKMSConfig(GCPKMSConfig{})
+	SetGCPKMSConfig(GCPKMSConfig{
+		Endpoint:    fake.URL,
+		TokenSource: GCPStaticToken{AccessToken: "mytoken"},
+	})
+
+	gcpKMSCrypter := GCPKMSCrypter{}
+	secret, decryptParams, err := gcpKMSCrypter.Encrypt("mypass", EncryptParams{"key": testGCPKey})
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{"key": testGCPKey, "v": "1"}, decryptParams)
+
+	plaintext, err := gcpKMSCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	plaintext, err = gcpKMSCrypter.DecryptContext(ctx, secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	_, err = gcpKMSCrypter.Decrypt("bm90aGluZw==", decryptParams)
+	assert.EqualError(t, err, "Cloud KMS error 400 on "+testGCPKey+":decrypt: Decryption failed: the ciphertext is invalid.")
+
+	_, err = gcpKMSCrypter.Decrypt(secret, DecryptParams{})
+	assert.EqualError(t, err, "Missing key parameter!")
+
+	_, _, err = gcpKMSCrypter.Encrypt("mypass", EncryptParams{})
+	assert.EqualError(t, err, "Missing key parameter!")
+}
+
+func TestGCPKMSInvalidKeys(t *testing.T) {
+	fake := newFakeGCPKMS()
+	defer fake.Close()
+	defer SetGCPKMSConfig(GCPKMSConfig{})
+	SetGCPKMSConfig(GCPKMSConfig{
+		Endpoint:    fake.URL,
+		TokenSource: GCPStaticToken{AccessToken: "mytoken"},
+	})
+
+	gcpKMSCrypter := GCPKMSCrypter{}
+	for _, key := range []string{
+		testGCPKey + "/cryptoKeyVersions/1:destroy?x=",
+		testGCPKey + "/cryptoKeyVersions/1",
+		testGCPKey + "?x=",
+		testGCPKey + "#",
+		"projects/myproject/locations/global/keyRings/myring/cryptoKeys/mykey%3Adestroy",
+		"projects/myproject/locations/global/keyRings/myring:destroy/cryptoKeys/mykey",
+		"projects/myproject/locations/global/keyRings/myring",
+		"/v1/" + testGCPKey,
+		"",
+	} {
+		_, err := gcpKMSCrypter.Decrypt("bm90aGluZw==", DecryptParams{"key": key, "v": "1"})
+		assert.EqualError(t, err, "Invalid key parameter '"+key+"'")
+		_, _, err = gcpKMSCrypter.Encrypt("mypass", EncryptParams{"key": key})
+		assert.EqualError(t, err, "Invalid key parameter '"+key+"'")
+	}
+	assert.Equal(t, 0, fake.requestCount())
+}
+
+func TestGCPKMSEncryptionContext(t *testing.T) {
+	fake := newFakeGCPKMS()
+	defer fake.Close()
+	defer SetGCPKMSConfig(GCPKMSConfig{})
+	SetGCPKMSConfig(GCPKMSConfig{
+		Endpoint:    fake.URL,
+		TokenSource: GCPStaticToken{AccessToken: "mytoken"},
+	})
+
+	gcpKMSCrypter := GCPKMSCrypter{}
+	secret, decryptParams, err := gcpKMSCrypter.Encrypt("mypass", EncryptParams{
+		"key":             testGCPKey,
+		"context.service": "myservice",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "myservice", decryptParams["context.service"])
+
+	plaintext, err := gcpKMSCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	decryptParams["context.service"] = "otherservice"
+	_, err = gcpKMSCrypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err, "wrong encryption context")
+}
+
+func TestGCPKMSMetadataToken(t *testing.T) {
+	fake := newFakeGCPKMS()
+	defer fake.Close()
+	defer SetGCPKMSConfig(GCPKMSConfig{})
+	os.Setenv(GCPKMSEndpointEnv, fake.URL)
+	defer os.Unsetenv(GCPKMSEndpointEnv)
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(fake.URL, "http://"))
+	defer os.Unsetenv("GCE_METADATA_HOST")
+	SetGCPKMSConfig(GCPKMSConfig{})
+
+	gcpKMSCrypter := GCPKMSCrypter{}
+	secret, decryptParams, err := gcpKMSCrypter.Encrypt("mypass", EncryptParams{"key": testGCPKey})
+	assert.NoError(t, err)
+	plaintext, err := gcpKMSCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, 1, fake.tokenIssued, "token is cached until it expires")
+
+	// a revoked token is replaced
+	fake.revokeTokens()
+	plaintext, err = gcpKMSCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, 2, fake.tokenIssued)
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sendJSON sends a request with the JSON encoded body, if any, and decodes a
+// 200 OK response into out. Any other response is decoded into errOut on a
+// best effort basis and only reported by its status code, so that callers
+// can format the service's error.
+func sendJSON(ctx context.Context, client *http.Client, method, url string, header http.Header, body, out, errOut interface{}) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_ = json.NewDecoder(resp.Body).Decode(errOut)
+		return resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
+
+// tokenExpiryMargin is how long before its expiry a cached access token is
+// replaced.
+const tokenExpiryMargin = time.Minute
+
+// tokenCache holds the configuration of a service client together with the
+// access token obtained with it. Changing the configuration drops the token,
+// and a generation counter keeps a fetch racing with the change from caching
+// a token of the old configuration.
+type tokenCache struct {
+	// fetch obtains a new access token for the configuration. A zero expiry
+	// means the token is not cached, unless cacheUnexpiring is set, in which
+	// case it is cached until the service rejects it.
+	fetch           func(ctx context.Context, config interface{}) (string, time.Time, error)
+	cacheUnexpiring bool
+	// rejectedStatus is the HTTP status with which the service rejects a
+	// token, e.g. after it is revoked.
+	rejectedStatus int
+
+	lock       sync.Mutex
+	config     interface{}
+	token      string
+	expiry     time.Time
+	generation int
+}
+
+func (c *tokenCache) setConfig(config interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.config = config
+	c.token = ""
+	c.generation++
+}
+
+// call calls send with the cached access token, or a freshly fetched one,
+// and fetches a new token once if the service rejects it. The configuration
+// is passed to check, if not nil, before any token is fetched.
+func (c *tokenCache) call(ctx context.Context, check func(config interface{}) error, send func(config interface{}, token string) (int, error)) error {
+	c.lock.Lock()
+	config, token, generation := c.config, c.token, c.generation
+	if !(c.cacheUnexpiring && c.expiry.IsZero()) && time.Now().Add(tokenExpiryMargin).After(c.expiry) {
+		token = ""
+	}
+	c.lock.Unlock()
+	if check != nil {
+		if err := check(config); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if token == "" {
+			var expiry time.Time
+			var err error
+			token, expiry, err = c.fetch(ctx, config)
+			if err != nil {
+				return err
+			}
+			c.store(generation, token, expiry)
+		}
+		status, err := send(config, token)
+		if status == c.rejectedStatus && attempt == 0 {
+			token = ""
+			continue
+		}
+		return err
+	}
+}
+
+func (c *tokenCache) store(generation int, token string, expiry time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.generation == generation {
+		c.token, c.expiry = token, expiry
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// awsJSONContentType is the content type of the AWS JSON protocol used by
+// KMS and SSM.
+const awsJSONContentType = "application/x-amz-json-1.1"
+
+func writeJSON(w http.ResponseWriter, contentType string, status int, body interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// respondJSON writes the JSON response of a fake REST service.
+func respondJSON(w http.ResponseWriter, status int, body interface{}) {
+	writeJSON(w, "application/json", status, body)
+}
+
+// respondAWS writes a successful response of the AWS JSON protocol.
+func respondAWS(w http.ResponseWriter, body interface{}) {
+	writeJSON(w, awsJSONContentType, http.StatusOK, body)
+}
+
+// failAWS writes an error response of the AWS JSON protocol.
+func failAWS(w http.ResponseWriter, errorType, message string) {
+	writeJSON(w, awsJSONContentType, http.StatusBadRequest, map[string]string{"__type": errorType, "message": message})
+}
+
+func TestTokenCache(t *testing.T) {
+	fetches := 0
+	cache := &tokenCache{
+		fetch: func(ctx context.Context, config interface{}) (string, time.Time, error) {
+			fetches++
+			if config.(string) == "broken" {
+				return "", time.Time{}, fmt.Errorf("no token")
+			}
+			return fmt.Sprintf("%s-%d", config, fetches), time.Now().Add(time.Hour), nil
+		},
+		rejectedStatus: http.StatusUnauthorized,
+		config:         "a",
+	}
+	var tokens []string
+	send := func(config interface{}, token string) (int, error) {
+		tokens = append(tokens, token)
+		return http.StatusOK, nil
+	}
+
+	assert.NoError(t, cache.call(context.Background(), nil, send))
+	assert.NoError(t, cache.call(context.Background(), nil, send))
+	assert.Equal(t, []string{"a-1", "a-1"}, tokens)
+
+	// a rejected token is replaced once
+	tokens = nil
+	err := cache.call(context.Background(), nil, func(config interface{}, token string) (int, error) {
+		tokens = append(tokens, token)
+		return http.StatusUnauthorized, fmt.Errorf("rejected")
+	})
+	assert.EqualError(t, err, "rejected")
+	assert.Equal(t, []string{"a-1", "a-2"}, tokens)
+
+	// changing the configuration drops the token
+	cache.setConfig("b")
+	tokens = nil
+	assert.NoError(t, cache.call(context.Background(), nil, send))
+	assert.Equal(t, []string{"b-3"}, tokens)
+
+	// the check runs before any token is fetched
+	cache.setConfig("broken")
+	err = cache.call(context.Background(), func(config interface{}) error {
+		return fmt.Errorf("untrusted %s", config)
+	}, send)
+	assert.EqualError(t, err, "untrusted broken")
+	assert.Equal(t, 3, fetches)
+	assert.EqualError(t, cache.call(context.Background(), nil, send), "no token")
+
+	// a token fetched for a replaced configuration is not cached
+	cache.setConfig("c")
+	cache.store(0, "stale", time.Now().Add(time.Hour))
+	tokens = nil
+	assert.NoError(t, cache.call(context.Background(), nil, send))
+	assert.Equal(t, []string{"c-5"}, tokens)
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	for _, cacheUnexpiring := range []bool{false, true} {
+		fetches := 0
+		cache := &tokenCache{
+			fetch: func(ctx context.Context, config interface{}) (string, time.Time, error) {
+				fetches++
+				return "mytoken", time.Time{}, nil
+			},
+			cacheUnexpiring: cacheUnexpiring,
+		}
+		send := func(config interface{}, token string) (int, error) {
+			return http.StatusOK, nil
+		}
+		assert.NoError(t, cache.call(context.Background(), nil, send))
+		assert.NoError(t, cache.call(context.Background(), nil, send))
+		if cacheUnexpiring {
+			assert.Equal(t, 1, fetches)
+		} else {
+			assert.Equal(t, 2, fetches, "tokens without expiry are not cached")
+		}
+
+		// tokens about to expire are replaced
+		cache.store(cache.generation, "mytoken", time.Now().Add(tokenExpiryMargin/2))
+		assert.NoError(t, cache.call(context.Background(), nil, send))
+		if cacheUnexpiring {
+			assert.Equal(t, 2, fetches)
+		} else {
+			assert.Equal(t, 3, fetches)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// passwordKDF derives an encryption key from a password and records its
+// parameters in the decrypt params of the secret.
+type passwordKDF interface {
+	deriveKey(password, salt []byte) ([]byte, error)
+	decryptParams() DecryptParams
+}
+
+// ScryptParams are the cost parameters of the scrypt key derivation.
+type ScryptParams struct {
+	N      int
+	R      int
+	P      int
+	KeyLen int
+}
+
+// DefaultScryptParams are used for new password secrets unless overridden.
+var DefaultScryptParams = ScryptParams{N: 1 << 15, R: 8, P: 1, KeyLen: 32}
+
+// legacyScryptParams were used by version 1 password secrets, which do not
+// record them.
+var legacyScryptParams = ScryptParams{N: 1024, R: 1, P: 1, KeyLen: 24}
+
+// maxScryptN, maxScryptR and maxScryptP bound the work a crafted secret can
+// make us do, and maxScryptMemory the memory, about 128·N·r bytes, it can make
+// us allocate: that of the largest N at the default r, 4 GiB.
+const maxScryptN = 1 << 22
+const maxScryptR = 32
+const maxScryptP = 16
+const maxScryptMemory = 128 * maxScryptN * 8
+
+// Argon2idParams are the cost parameters of the Argon2id key derivation.
+// Memory is in KiB.
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	KeyLen      int
+}
+
+// DefaultArgon2idParams are used for new Argon2id password secrets unless
+// overridden. They follow the second recommended option of RFC 9106.
+var DefaultArgon2idParams = Argon2idParams{Memory: 64 * 1024, Iterations: 3, Parallelism: 4, KeyLen: 32}
+
+// maxArgon2Memory and maxArgon2Iterations bound the work a crafted secret can
+// make us do.
+const maxArgon2Memory = 1 << 21
+const maxArgon2Iterations = 64
+
+func (p ScryptParams) deriveKey(password, salt []byte) ([]byte, error) {
+	return scrypt.Key(password, salt, p.N, p.R, p.P, p.KeyLen)
+}
+
+func (p ScryptParams) decryptParams() DecryptParams {
+	return DecryptParams{
+		"kdf":    "scrypt",
+		"N":      strconv.Itoa(p.N),
+		"r":      strconv.Itoa(p.R),
+		"p":      strconv.Itoa(p.P),
+		"keylen": strconv.Itoa(p.KeyLen),
+	}
+}
+
+func (p ScryptParams) validate() error {
+	if p.N <= 1 || p.N&(p.N-1) != 0 || p.N > maxScryptN {
+		return fmt.Errorf("scrypt N must be a power of 2 between 2 and %d, got %d", maxScryptN, p.N)
+	}
+	if p.R <= 0 || p.R > maxScryptR || p.P <= 0 || p.P > maxScryptP {
+		return fmt.Errorf("Invalid scrypt parameters r=%d, p=%d, r must be between 1 and %d and p between 1 and %d", p.R, p.P, maxScryptR, maxScryptP)
+	}
+	if 128*int64(p.N)*int64(p.R) > maxScryptMemory {
+		return fmt.Errorf("scrypt parameters N=%d, r=%d need more than the maximum of %d bytes of memory", p.N, p.R, int64(maxScryptMemory))
+	}
+	return validateKeyLen(p.KeyLen)
+}
+
+func validateKeyLen(keyLen int) error {
+	if keyLen < 16 || keyLen > 64 {
+		return fmt.Errorf("Key length must be between 16 and 64 bytes, got %d", keyLen)
+	}
+	return nil
+}
+
+func (p Argon2idParams) deriveKey(password, salt []byte) ([]byte, error) {
+	return argon2.IDKey(password, salt, p.Iterations, p.Memory, p.Parallelism, uint32(p.KeyLen)), nil
+}
+
+func (p Argon2idParams) decryptParams() DecryptParams {
+	return DecryptParams{
+		"kdf":    "argon2id",
+		"m":      strconv.FormatUint(uint64(p.Memory), 10),
+		"t":      strconv.FormatUint(uint64(p.Iterations), 10),
+		"p":      strconv.FormatUint(uint64(p.Parallelism), 10),
+		"keylen": strconv.Itoa(p.KeyLen),
+	}
+}
+
+func (p Argon2idParams) validate() error {
+	if p.Parallelism == 0 {
+		return fmt.Errorf("Argon2id parallelism must be between 1 and 255")
+	}
+	if p.Memory < 8*uint32(p.Parallelism) || p.Memory > maxArgon2Memory {
+		return fmt.Errorf("Argon2id memory must be between %d and %d KiB, got %d", 8*uint32(p.Parallelism), maxArgon2Memory, p.Memory)
+	}
+	if p.Iterations == 0 || p.Iterations > maxArgon2Iterations {
+		return fmt.Errorf("Argon2id iterations must be between 1 and %d, got %d", maxArgon2Iterations, p.Iterations)
+	}
+	return validateKeyLen(p.KeyLen)
+}
+
+func newArgon2idParams(memory, iterations, parallelism, keyLen int) (Argon2idParams, error) {
+	if memory < 0 || memory > maxArgon2Memory || iterations < 0 || iterations > maxArgon2Iterations || parallelism < 0 || parallelism > 255 {
+		return Argon2idParams{}, fmt.Errorf("Invalid Argon2id parameters m=%d, t=%d, p=%d", memory, iterations, parallelism)
+	}
+	params := Argon2idParams{
+		Memory:      uint32(memory),
+		Iterations:  uint32(iterations),
+		Parallelism: uint8(parallelism),
+		KeyLen:      keyLen,
+	}
+	return params, params.validate()
+}
+
+// passwordKDFFromEncryptParams returns the key derivation requested in the
+// encrypt params, which defaults to scrypt.
+func passwordKDFFromEncryptParams(encryptParams EncryptParams) (passwordKDF, error) {
+	switch kdf := encryptParams["kdf"]; kdf {
+	case "", "scrypt":
+		return scryptParamsFromEncryptParams(encryptParams)
+	case "argon2id":
+		return argon2idParamsFromEncryptParams(encryptParams)
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation function '%s'", kdf)
+	}
+}
+
+// argon2idParamsFromEncryptParams returns the Argon2id parameters requested
+// in the encrypt params, falling back to DefaultArgon2idParams.
+func argon2idParamsFromEncryptParams(encryptParams EncryptParams) (Argon2idParams, error) {
+	defaults := DefaultArgon2idParams
+	memory, err := intParam(encryptParams, "argon2Memory", int(defaults.Memory))
+	if err != nil {
+		return defaults, err
+	}
+	iterations, err := intParam(encryptParams, "argon2Iterations", int(defaults.Iterations))
+	if err != nil {
+		return defaults, err
+	}
+	parallelism, err := intParam(encryptParams, "argon2Parallelism", int(defaults.Parallelism))
+	if err != nil {
+		return defaults, err
+	}
+	return newArgon2idParams(memory, iterations, parallelism, defaults.KeyLen)
+}
+
+// scryptParamsFromEncryptParams returns the scrypt parameters requested in
+// the encrypt params, falling back to DefaultScryptParams.
+func scryptParamsFromEncryptParams(encryptParams EncryptParams) (ScryptParams, error) {
+	params := DefaultScryptParams
+	var err error
+	if params.N, err = intParam(encryptParams, "scryptN", params.N); err != nil {
+		return params, err
+	}
+	if params.R, err = intParam(encryptParams, "scryptR", params.R); err != nil {
+		return params, err
+	}
+	if params.P, err = intParam(encryptParams, "scryptP", params.P); err != nil {
+		return params, err
+	}
+	return params, params.validate()
+}
+
+// parsePasswordKDF returns the key derivation recorded in the decrypt params.
+func parsePasswordKDF(decryptParams DecryptParams) (passwordKDF, error) {
+	switch kdf := decryptParams["kdf"]; kdf {
+	case "scrypt":
+		var params ScryptParams
+		var err error
+		if params.N, err = requiredIntParam(decryptParams, "N"); err != nil {
+			return nil, err
+		}
+		if params.R, err = requiredIntParam(decryptParams, "r"); err != nil {
+			return nil, err
+		}
+		if params.P, err = requiredIntParam(decryptParams, "p"); err != nil {
+			return nil, err
+		}
+		if params.KeyLen, err = requiredIntParam(decryptParams, "keylen"); err != nil {
+			return nil, err
+		}
+		return params, params.validate()
+	case "argon2id":
+		var memory, iterations, parallelism, keyLen int
+		var err error
+		if memory, err = requiredIntParam(decryptParams, "m"); err != nil {
+			return nil, err
+		}
+		if iterations, err = requiredIntParam(decryptParams, "t"); err != nil {
+			return nil, err
+		}
+		if parallelism, err = requiredIntParam(decryptParams, "p"); err != nil {
+			return nil, err
+		}
+		if keyLen, err = requiredIntParam(decryptParams, "keylen"); err != nil {
+			return nil, err
+		}
+		return newArgon2idParams(memory, iterations, parallelism, keyLen)
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation function '%s'", kdf)
+	}
+}
+
+func intParam(params map[string]string, name string, defaultValue int) (int, error) {
+	value, ok := params[name]
+	if !ok || value == "" {
+		return defaultValue, nil
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s parameter '%s'", name, value)
+	}
+	return intValue, nil
+}
+
+func requiredIntParam(params map[string]string, name string) (int, error) {
+	if _, ok := params[name]; !ok {
+		return 0, fmt.Errorf("Missing %s parameter!", name)
+	}
+	return intParam(params, name, 0)
+}
@@ -3,21 +3,68 @@
 package internal
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kms"
 	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 )
 
 type KMSCrypter struct{}
 
+// kmsVersion is the format of secrets encrypted directly with KMS and
+// kmsEnvelopeVersion of secrets encrypted locally with a KMS data key.
+const kmsVersion = "1"
+const kmsEnvelopeVersion = "2"
+
+// kmsMaxPlaintextSize is the largest plaintext KMS encrypts directly. Larger
+// plaintexts are envelope encrypted.
+const kmsMaxPlaintextSize = 4096
+
+// encryptionContextPrefix prefixes the encrypt and decrypt params holding
+// the KMS encryption context, e.g. context.service=myservice.
+const encryptionContextPrefix = "context."
+
 var kmsClients = make(map[string]kmsiface.KMSAPI)
 var clientsLock sync.RWMutex
 
+// KMSEndpointEnv names the environment variable overriding the KMS endpoint,
+// e.g. to use a local KMS emulator.
+const KMSEndpointEnv = "SECRETCRYPT_KMS_ENDPOINT"
+
+var kmsEndpoint string
+var kmsEndpointLock sync.RWMutex
+
+// SetKMSEndpoint overrides the KMS endpoint URL for all regions. It takes
+// precedence over the endpoint in the AWS configuration, which in turn takes
+// precedence over the SECRETCRYPT_KMS_ENDPOINT environment variable. Passing
+// "" removes the override.
+func SetKMSEndpoint(endpoint string) {
+	kmsEndpointLock.Lock()
+	kmsEndpoint = endpoint
+	kmsEndpointLock.Unlock()
+	ResetKMSClients()
+}
+
+// kmsEndpointOverride returns the endpoint replacing configured, the endpoint
+// from the AWS configuration, or "" to keep it.
+func kmsEndpointOverride(configured string) string {
+	kmsEndpointLock.RLock()
+	defer kmsEndpointLock.RUnlock()
+	if kmsEndpoint != "" {
+		return kmsEndpoint
+	}
+	if configured != "" {
+		return ""
+	}
+	return os.Getenv(KMSEndpointEnv)
+}
+
 // KMSAPI wraps kmsiface.KMSAPI so that we can generate mock
 type KMSAPI interface {
 	kmsiface.KMSAPI
@@ -38,58 +85,333 @@ func (c KMSCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciph
 		return Ciphertext(""), nil, fmt.Errorf("Missing keyID parameter!")
 	}
 
-	resp, err := kmsClient(region).Encrypt(
+	decryptParams := DecryptParams{"region": region}
+	if fallbackRegions := encryptParams["fallbackRegions"]; fallbackRegions != "" {
+		decryptParams["fallback"] = fallbackRegions
+	}
+	encryptionContext := encryptionContextParams(encryptParams)
+	for key, value := range encryptionContext {
+		decryptParams[key] = value
+	}
+
+	if len(plaintext) > kmsMaxPlaintextSize || encryptParams["envelope"] == "true" {
+		return c.encryptEnvelope(plaintext, region, keyID, encryptionContext, decryptParams)
+	}
+
+	client, err := kmsClient(region)
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+	resp, err := client.Encrypt(
 		&kms.EncryptInput{
-			Plaintext: []byte(plaintext),
-			KeyId:     aws.String(keyID),
+			Plaintext:         []byte(plaintext),
+			KeyId:             aws.String(keyID),
+			EncryptionContext: awsEncryptionContext(encryptionContext),
 		},
 	)
 	if err != nil {
 		return Ciphertext(""), nil, err
 	}
 
+	if resp.KeyId != nil {
+		decryptParams["key"] = *resp.KeyId
+	}
 	ciphertext := base64.StdEncoding.EncodeToString(resp.CiphertextBlob)
-	decryptParams := DecryptParams{"region": region}
-	return Ciphertext(ciphertext), decryptParams, nil
+	return Ciphertext(ciphertext), withVersion(kmsVersion, decryptParams), nil
 }
 
-func (c KMSCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
-	region, ok := decryptParams["region"]
-	if !ok {
-		return "", fmt.Errorf("Missing region parameter!")
+// encryptEnvelope encrypts the plaintext locally with a fresh KMS data key
+// and stores the data key, wrapped by KMS, in the decrypt params.
+func (c KMSCrypter) encryptEnvelope(plaintext, region, keyID string, encryptionContext map[string]string, decryptParams DecryptParams) (Ciphertext, DecryptParams, error) {
+	key, wrappedKey, keyARN, err := c.dataKey(region, keyID, encryptionContext)
+	if err != nil {
+		return Ciphertext(""), nil, err
 	}
+	defer wipe(key)
 
-	ciphertextBlob, err := base64.StdEncoding.DecodeString(string(ciphertext))
+	ciphertext, err := AESEncrypt(key, plaintext)
 	if err != nil {
-		return "", err
+		return Ciphertext(""), nil, fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+
+	decryptParams["datakey"] = wrappedKey
+	if keyARN != "" {
+		decryptParams["key"] = keyARN
+	}
+	return Ciphertext(ciphertext), withVersion(kmsEnvelopeVersion, decryptParams), nil
+}
+
+// dataKey returns a data key, its base64 encoded wrapped form and the ARN of
+// the KMS key wrapping it, reusing a cached one if the data key cache is
+// enabled.
+func (c KMSCrypter) dataKey(region, keyID string, encryptionContext map[string]string) ([]byte, string, string, error) {
+	cacheKey := dataKeyCacheKey(encryptionContext, []byte("encrypt"), []byte(region), []byte(keyID))
+	if key, wrappedKey, keyARN, ok := cachedDataKey(cacheKey); ok {
+		return key, wrappedKey, keyARN, nil
 	}
 
-	resp, err := kmsClient(region).Decrypt(
-		&kms.DecryptInput{
-			CiphertextBlob: ciphertextBlob,
+	client, err := kmsClient(region)
+	if err != nil {
+		return nil, "", "", err
+	}
+	resp, err := client.GenerateDataKey(
+		&kms.GenerateDataKeyInput{
+			KeyId:             aws.String(keyID),
+			KeySpec:           aws.String(kms.DataKeySpecAes256),
+			EncryptionContext: awsEncryptionContext(encryptionContext),
 		},
 	)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	wrappedKey := base64.StdEncoding.EncodeToString(resp.CiphertextBlob)
+	keyARN := aws.StringValue(resp.KeyId)
+	cacheDataKey(cacheKey, resp.Plaintext, wrappedKey, keyARN)
+	// cached data keys for decryption must be protected by an allowed key
+	if checkKMSKeyAllowed(keyARN) == nil {
+		cacheDataKey(dataKeyCacheKey(encryptionContext, []byte("decrypt"), []byte(wrappedKey)), resp.Plaintext, "", "")
+	}
+	return resp.Plaintext, wrappedKey, keyARN, nil
+}
+
+func (c KMSCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.DecryptContext(context.Background(), ciphertext, decryptParams)
+}
+
+func (c KMSCrypter) DecryptContext(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(ctx, c.Name(), ciphertext, decryptParams)
+}
+
+func (c KMSCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+		"2": c.decryptEnvelope,
+	}
+}
+
+func (c KMSCrypter) decryptV1(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	plaintext, err := c.decryptBlob(ctx, string(ciphertext), decryptParams)
 	if err != nil {
 		return "", err
 	}
+	return string(plaintext), nil
+}
+
+func (c KMSCrypter) decryptEnvelope(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	wrappedKey, ok := decryptParams["datakey"]
+	if !ok {
+		return "", fmt.Errorf("Missing datakey parameter!")
+	}
+	cacheKey := dataKeyCacheKey(encryptionContextParams(decryptParams), []byte("decrypt"), []byte(wrappedKey))
+	key, _, _, ok := cachedDataKey(cacheKey)
+	if !ok {
+		var err error
+		key, err = c.decryptBlob(ctx, wrappedKey, decryptParams)
+		if err != nil {
+			return "", fmt.Errorf("Error decrypting data key: %s", err)
+		}
+		cacheDataKey(cacheKey, key, "", "")
+	}
+	defer wipe(key)
 
-	return string(resp.Plaintext), nil
+	plaintext, err := AESDecrypt(key, string(ciphertext))
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting secret: %s", err)
+	}
+	return plaintext, nil
 }
 
-func kmsClient(region string) kmsiface.KMSAPI {
+// decryptBlob decrypts a base64 encoded KMS ciphertext blob, trying the
+// fallback regions in order if decryption in the primary region fails.
+func (c KMSCrypter) decryptBlob(ctx context.Context, b64blob string, decryptParams DecryptParams) ([]byte, error) {
+	region, ok := decryptParams["region"]
+	if !ok {
+		return nil, fmt.Errorf("Missing region parameter!")
+	}
+
+	ciphertextBlob, err := base64.StdEncoding.DecodeString(b64blob)
+	if err != nil {
+		return nil, err
+	}
+
+	regions := append([]string{region}, fallbackRegions(decryptParams)...)
+	var errs []string
+	for _, region := range regions {
+		plaintext, err := c.decryptBlobInRegion(ctx, region, ciphertextBlob, decryptParams)
+		if err == nil {
+			return plaintext, nil
+		}
+		if len(regions) == 1 {
+			return nil, err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", region, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("Error decrypting in all regions: %s", strings.Join(errs, "; "))
+}
+
+func (c KMSCrypter) decryptBlobInRegion(ctx context.Context, region string, ciphertextBlob []byte, decryptParams DecryptParams) ([]byte, error) {
+	input := &kms.DecryptInput{
+		CiphertextBlob:    ciphertextBlob,
+		EncryptionContext: awsEncryptionContext(encryptionContextParams(decryptParams)),
+	}
+	if keyARN, ok := decryptParams["key"]; ok {
+		keyARN = regionalKeyARN(keyARN, region)
+		if err := checkKMSKeyAllowed(keyARN); err != nil {
+			return nil, err
+		}
+		input.KeyId = aws.String(keyARN)
+	}
+
+	client, err := kmsClient(region)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.DecryptWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKMSKeyAllowed(aws.StringValue(resp.KeyId)); err != nil {
+		wipe(resp.Plaintext)
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// fallbackRegions returns the comma separated regions to try, in order, when
+// decryption in the primary region fails, e.g. for multi-Region keys.
+func fallbackRegions(decryptParams DecryptParams) []string {
+	var regions []string
+	for _, region := range strings.Split(decryptParams["fallback"], ",") {
+		if region = strings.TrimSpace(region); region != "" {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// encryptionContextParams returns the encryption context params, still
+// prefixed, from either encrypt or decrypt params.
+func encryptionContextParams(params map[string]string) map[string]string {
+	contextParams := make(map[string]string)
+	for key, value := range params {
+		if strings.HasPrefix(key, encryptionContextPrefix) {
+			contextParams[key] = value
+		}
+	}
+	return contextParams
+}
+
+func awsEncryptionContext(contextParams map[string]string) map[string]*string {
+	if len(contextParams) == 0 {
+		return nil
+	}
+	encryptionContext := make(map[string]*string, len(contextParams))
+	for key, value := range contextParams {
+		encryptionContext[strings.TrimPrefix(key, encryptionContextPrefix)] = aws.String(value)
+	}
+	return encryptionContext
+}
+
+var kmsAllowedKeys map[string]bool
+var kmsAllowedKeysLock sync.RWMutex
+
+// SetKMSAllowedKeys restricts decryption to ciphertexts protected by the
+// given KMS key ARNs. For multi-Region keys, list the ARN of every replica
+// used. Passing no ARNs lifts the restriction.
+func SetKMSAllowedKeys(keyARNs ...string) {
+	kmsAllowedKeysLock.Lock()
+	if len(keyARNs) == 0 {
+		kmsAllowedKeys = nil
+	} else {
+		kmsAllowedKeys = make(map[string]bool, len(keyARNs))
+		for _, keyARN := range keyARNs {
+			kmsAllowedKeys[keyARN] = true
+		}
+	}
+	kmsAllowedKeysLock.Unlock()
+	// cached data keys were unwrapped under the previous restriction
+	clearDataKeyCache()
+}
+
+func checkKMSKeyAllowed(keyARN string) error {
+	kmsAllowedKeysLock.RLock()
+	defer kmsAllowedKeysLock.RUnlock()
+	if kmsAllowedKeys != nil && !kmsAllowedKeys[keyARN] {
+		return fmt.Errorf("KMS key '%s' is not allowed", keyARN)
+	}
+	return nil
+}
+
+// regionalKeyARN returns the ARN of the replica of a multi-Region key in the
+// given region. Other key ARNs are returned unchanged.
+func regionalKeyARN(keyARN, region string) string {
+	tokens := strings.SplitN(keyARN, ":", 6)
+	if len(tokens) != 6 || tokens[0] != "arn" || !strings.HasPrefix(tokens[5], "key/mrk-") {
+		return keyARN
+	}
+	tokens[3] = region
+	return strings.Join(tokens, ":")
+}
+
+// KMSClientFactory creates the KMS client for a region. Clients are cached
+// per region until ResetKMSClients is called.
+type KMSClientFactory func(region string) (kmsiface.KMSAPI, error)
+
+var kmsClientFactory KMSClientFactory = newKMSClient
+
+// SetKMSClientFactory replaces how KMS clients are created, e.g. to inject a
+// fake client in tests. Passing nil restores the default factory, which
+// creates clients from the AWS configuration. Cached clients are dropped.
+func SetKMSClientFactory(factory KMSClientFactory) {
+	if factory == nil {
+		factory = newKMSClient
+	}
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	kmsClientFactory = factory
+	kmsClients = make(map[string]kmsiface.KMSAPI)
+}
+
+// ResetKMSClients drops all cached KMS clients, so that they are recreated
+// by the client factory when next used.
+func ResetKMSClients() {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+	kmsClients = make(map[string]kmsiface.KMSAPI)
+}
+
+func kmsClient(region string) (kmsiface.KMSAPI, error) {
 	clientsLock.RLock()
 	client, exists := kmsClients[region]
 	clientsLock.RUnlock()
 	if exists {
-		return client
+		return client, nil
 	}
 	clientsLock.Lock()
 	defer clientsLock.Unlock()
 	client, exists = kmsClients[region]
 	if exists {
-		return client
+		return client, nil
+	}
+	client, err := kmsClientFactory(region)
+	if err != nil {
+		return nil, err
 	}
-	client = kms.New(session.New(), &aws.Config{Region: aws.String(region)})
 	kmsClients[region] = client
-	return client
+	return client, nil
+}
+
+func newKMSClient(region string) (kmsiface.KMSAPI, error) {
+	sess, serviceConfig, err := awsSession(region)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating AWS session: %s", err)
+	}
+	if endpoint := kmsEndpointOverride(awsConfiguredEndpoint(sess, serviceConfig)); endpoint != "" {
+		serviceConfig.WithEndpoint(endpoint)
+	}
+	return kms.New(sess, serviceConfig), nil
 }
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DataKeyCacheConfig configures the in-process cache of KMS data keys used by
+// envelope encrypted secrets.
+type DataKeyCacheConfig struct {
+	// MaxAge is how long a data key is cached.
+	MaxAge time.Duration
+	// MaxUses is how many secrets a cached data key encrypts or decrypts
+	// before it is evicted. Zero means unlimited.
+	MaxUses int
+	// MaxEntries bounds the number of cached data keys, evicting the oldest
+	// first. Zero means defaultDataKeyCacheEntries.
+	MaxEntries int
+}
+
+const defaultDataKeyCacheEntries = 100
+
+type dataKeyCacheEntry struct {
+	key        []byte
+	wrappedKey string
+	keyARN     string
+	created    time.Time
+	uses       int
+}
+
+type dataKeyCache struct {
+	config  DataKeyCacheConfig
+	entries map[string]*dataKeyCacheEntry
+	now     func() time.Time
+}
+
+var kmsDataKeyCache *dataKeyCache
+var kmsDataKeyCacheLock sync.Mutex
+
+// EnableKMSDataKeyCache caches unwrapped KMS data keys, so that envelope
+// encrypted secrets sharing a data key cost a single KMS call. While enabled,
+// envelope encryption also reuses data keys for secrets with the same key ID
+// and encryption context. Re-enabling replaces the cache.
+func EnableKMSDataKeyCache(config DataKeyCacheConfig) {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = defaultDataKeyCacheEntries
+	}
+	kmsDataKeyCacheLock.Lock()
+	defer kmsDataKeyCacheLock.Unlock()
+	if kmsDataKeyCache != nil {
+		kmsDataKeyCache.clear()
+	}
+	kmsDataKeyCache = &dataKeyCache{
+		config:  config,
+		entries: make(map[string]*dataKeyCacheEntry),
+		now:     time.Now,
+	}
+}
+
+// DisableKMSDataKeyCache disables the cache and wipes all cached data keys.
+func DisableKMSDataKeyCache() {
+	kmsDataKeyCacheLock.Lock()
+	defer kmsDataKeyCacheLock.Unlock()
+	if kmsDataKeyCache != nil {
+		kmsDataKeyCache.clear()
+	}
+	kmsDataKeyCache = nil
+}
+
+// cachedDataKey returns a copy of the cached data key along with its wrapped
+// form and the ARN of the KMS key wrapping it.
+func cachedDataKey(cacheKey string) ([]byte, string, string, bool) {
+	kmsDataKeyCacheLock.Lock()
+	defer kmsDataKeyCacheLock.Unlock()
+	if kmsDataKeyCache == nil {
+		return nil, "", "", false
+	}
+	return kmsDataKeyCache.get(cacheKey)
+}
+
+// cacheDataKey caches a copy of the data key, if caching is enabled.
+func cacheDataKey(cacheKey string, key []byte, wrappedKey, keyARN string) {
+	kmsDataKeyCacheLock.Lock()
+	defer kmsDataKeyCacheLock.Unlock()
+	if kmsDataKeyCache == nil {
+		return
+	}
+	kmsDataKeyCache.put(cacheKey, key, wrappedKey, keyARN)
+}
+
+// clearDataKeyCache wipes all cached data keys but leaves caching enabled.
+func clearDataKeyCache() {
+	kmsDataKeyCacheLock.Lock()
+	defer kmsDataKeyCacheLock.Unlock()
+	if kmsDataKeyCache != nil {
+		kmsDataKeyCache.clear()
+	}
+}
+
+func (c *dataKeyCache) get(cacheKey string) ([]byte, string, string, bool) {
+	entry, exists := c.entries[cacheKey]
+	if !exists {
+		return nil, "", "", false
+	}
+	if c.now().Sub(entry.created) >= c.config.MaxAge {
+		c.evict(cacheKey)
+		return nil, "", "", false
+	}
+	entry.uses++
+	key := append([]byte(nil), entry.key...)
+	wrappedKey, keyARN := entry.wrappedKey, entry.keyARN
+	if c.config.MaxUses > 0 && entry.uses >= c.config.MaxUses {
+		c.evict(cacheKey)
+	}
+	return key, wrappedKey, keyARN, true
+}
+
+func (c *dataKeyCache) put(cacheKey string, key []byte, wrappedKey, keyARN string) {
+	// the caller has used the key once already
+	if c.config.MaxAge <= 0 || c.config.MaxUses == 1 {
+		return
+	}
+	if _, exists := c.entries[cacheKey]; exists {
+		c.evict(cacheKey)
+	}
+	for len(c.entries) >= c.config.MaxEntries {
+		c.evictOldest()
+	}
+	c.entries[cacheKey] = &dataKeyCacheEntry{
+		key:        append([]byte(nil), key...),
+		wrappedKey: wrappedKey,
+		keyARN:     keyARN,
+		created:    c.now(),
+		uses:       1,
+	}
+}
+
+func (c *dataKeyCache) evict(cacheKey string) {
+	wipe(c.entries[cacheKey].key)
+	delete(c.entries, cacheKey)
+}
+
+func (c *dataKeyCache) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for cacheKey, entry := range c.entries {
+		if oldestKey == "" || entry.created.Before(oldest) {
+			oldestKey, oldest = cacheKey, entry.created
+		}
+	}
+	c.evict(oldestKey)
+}
+
+func (c *dataKeyCache) clear() {
+	for cacheKey := range c.entries {
+		c.evict(cacheKey)
+	}
+}
+
+// dataKeyCacheKey identifies a data key by a digest of the given parts and
+// the encryption context it is bound to.
+func dataKeyCacheKey(encryptionContext map[string]string, parts ...[]byte) string {
+	digest := sha256.New()
+	write := func(part []byte) {
+		fmt.Fprintf(digest, "%d:", len(part))
+		digest.Write(part)
+	}
+	for _, part := range parts {
+		write(part)
+	}
+	keys := make([]string, 0, len(encryptionContext))
+	for key := range encryptionContext {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		write([]byte(key))
+		write([]byte(encryptionContext[key]))
+	}
+	return hex.EncodeToString(digest.Sum(nil))
+}
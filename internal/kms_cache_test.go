@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDataKeyCache(config DataKeyCacheConfig) (*dataKeyCache, *time.Time) {
+	now := time.Unix(0, 0)
+	cache := &dataKeyCache{
+		config:  config,
+		entries: make(map[string]*dataKeyCacheEntry),
+		now:     func() time.Time { return now },
+	}
+	return cache, &now
+}
+
+func TestDataKeyCacheMaxAge(t *testing.T) {
+	cache, now := newTestDataKeyCache(DataKeyCacheConfig{MaxAge: time.Minute, MaxEntries: 10})
+	cache.put("a", []byte("key"), "wrapped", "arn")
+
+	key, wrappedKey, keyARN, ok := cache.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("key"), key)
+	assert.Equal(t, "wrapped", wrappedKey)
+	assert.Equal(t, "arn", keyARN)
+
+	*now = now.Add(time.Minute)
+	_, _, _, ok = cache.get("a")
+	assert.False(t, ok)
+	assert.Empty(t, cache.entries)
+}
+
+func TestDataKeyCacheMaxUses(t *testing.T) {
+	cache, _ := newTestDataKeyCache(DataKeyCacheConfig{MaxAge: time.Minute, MaxUses: 3, MaxEntries: 10})
+	cache.put("a", []byte("key"), "", "")
+
+	_, _, _, ok := cache.get("a")
+	assert.True(t, ok)
+	_, _, _, ok = cache.get("a")
+	assert.True(t, ok)
+	_, _, _, ok = cache.get("a")
+	assert.False(t, ok)
+
+	cache, _ = newTestDataKeyCache(DataKeyCacheConfig{MaxAge: time.Minute, MaxUses: 1, MaxEntries: 10})
+	cache.put("a", []byte("key"), "", "")
+	_, _, _, ok = cache.get("a")
+	assert.False(t, ok)
+}
+
+func TestDataKeyCacheMaxEntries(t *testing.T) {
+	cache, now := newTestDataKeyCache(DataKeyCacheConfig{MaxAge: time.Minute, MaxEntries: 2})
+	cache.put("a", []byte("key-a"), "", "")
+	*now = now.Add(time.Second)
+	cache.put("b", []byte("key-b"), "", "")
+	*now = now.Add(time.Second)
+	cache.put("c", []byte("key-c"), "", "")
+
+	assert.Len(t, cache.entries, 2)
+	_, _, _, ok := cache.get("a")
+	assert.False(t, ok, "oldest entry is evicted")
+	_, _, _, ok = cache.get("c")
+	assert.True(t, ok)
+}
+
+func TestDataKeyCacheReturnsCopy(t *testing.T) {
+	cache, _ := newTestDataKeyCache(DataKeyCacheConfig{MaxAge: time.Minute, MaxEntries: 10})
+	key := []byte("key")
+	cache.put("a", key, "", "")
+	wipe(key)
+
+	cached, _, _, _ := cache.get("a")
+	wipe(cached)
+	cached, _, _, _ = cache.get("a")
+	assert.Equal(t, []byte("key"), cached)
+}
+
+func TestDataKeyCacheKey(t *testing.T) {
+	assert.Equal(t,
+		dataKeyCacheKey(map[string]string{"a": "1", "b": "2"}, []byte("x")),
+		dataKeyCacheKey(map[string]string{"b": "2", "a": "1"}, []byte("x")),
+	)
+	assert.NotEqual(t,
+		dataKeyCacheKey(map[string]string{"a": "1"}, []byte("x")),
+		dataKeyCacheKey(map[string]string{"a": "2"}, []byte("x")),
+	)
+	assert.NotEqual(t,
+		dataKeyCacheKey(nil, []byte("ab"), []byte("c")),
+		dataKeyCacheKey(nil, []byte("a"), []byte("bc")),
+	)
+}
@@ -1,17 +1,32 @@
 package internal
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
-func TestKms(t *testing.T) {
+func useMockKMS(t *testing.T) *MockKMSAPI {
 	mockKMS := &MockKMSAPI{}
+	SetKMSClientFactory(func(region string) (kmsiface.KMSAPI, error) {
+		assert.Equal(t, "myregion", region)
+		return mockKMS, nil
+	})
+	return mockKMS
+}
+
+func TestKms(t *testing.T) {
+	mockKMS := useMockKMS(t)
+	defer SetKMSClientFactory(nil)
 	defer mockKMS.AssertExpectations(t)
-	kmsClients["myregion"] = mockKMS
 	kmsCrypter := KMSCrypter{}
 
 	mockKMS.On("Encrypt",
@@ -31,10 +46,12 @@ func TestKms(t *testing.T) {
 	})
 	assert.Equal(t, myDecryptParams, DecryptParams{
 		"region": "myregion",
+		"v":      "1",
 	})
 	assert.NoError(t, err)
 
-	mockKMS.On("Decrypt",
+	mockKMS.On("DecryptWithContext",
+		mock.Anything,
 		&kms.DecryptInput{
 			CiphertextBlob: []byte("myciphertextblob"),
 		},
@@ -49,7 +66,475 @@ func TestKms(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "mypass", plaintext)
 
+	plaintext, err = kmsCrypter.DecryptContext(context.Background(), secret, myDecryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
 	plaintext, err = kmsCrypter.Decrypt("@Not_base64 !!!", myDecryptParams)
 	assert.Error(t, err)
 	assert.Zero(t, plaintext)
 }
+
+func TestKmsDecryptContextCancelled(t *testing.T) {
+	mockKMS := useMockKMS(t)
+	defer SetKMSClientFactory(nil)
+	defer mockKMS.AssertExpectations(t)
+	kmsCrypter := KMSCrypter{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mockKMS.On("DecryptWithContext",
+		ctx,
+		&kms.DecryptInput{
+			CiphertextBlob: []byte("myciphertextblob"),
+		},
+	).Return(nil, context.Canceled)
+
+	plaintext, err := kmsCrypter.DecryptContext(ctx, "bXljaXBoZXJ0ZXh0YmxvYg==", DecryptParams{
+		"region": "myregion",
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Zero(t, plaintext)
+}
+
+func TestKmsEncryptionContext(t *testing.T) {
+	mockKMS := useMockKMS(t)
+	defer SetKMSClientFactory(nil)
+	defer mockKMS.AssertExpectations(t)
+	kmsCrypter := KMSCrypter{}
+
+	encryptionContext := map[string]*string{
+		"service":     aws.String("myservice"),
+		"environment": aws.String("prod"),
+	}
+	mockKMS.On("Encrypt",
+		&kms.EncryptInput{
+			KeyId:             aws.String("mykey"),
+			Plaintext:         []byte("mypass"),
+			EncryptionContext: encryptionContext,
+		},
+	).Return(
+		&kms.EncryptOutput{
+			CiphertextBlob: []byte("myciphertextblob"),
+		},
+		nil,
+	)
+	secret, myDecryptParams, err := kmsCrypter.Encrypt("mypass", map[string]string{
+		"region":              "myregion",
+		"keyID":               "mykey",
+		"context.service":     "myservice",
+		"context.environment": "prod",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{
+		"region":              "myregion",
+		"v":                   "1",
+		"context.service":     "myservice",
+		"context.environment": "prod",
+	}, myDecryptParams)
+
+	mockKMS.On("DecryptWithContext",
+		mock.Anything,
+		&kms.DecryptInput{
+			CiphertextBlob:    []byte("myciphertextblob"),
+			EncryptionContext: encryptionContext,
+		},
+	).Return(
+		&kms.DecryptOutput{
+			Plaintext: []byte("mypass"),
+		},
+		nil,
+	)
+	mockKMS.On("DecryptWithContext",
+		mock.Anything,
+		&kms.DecryptInput{
+			CiphertextBlob: []byte("myciphertextblob"),
+			EncryptionContext: map[string]*string{
+				"service":     aws.String("otherservice"),
+				"environment": aws.String("prod"),
+			},
+		},
+	).Return(nil, fmt.Errorf("InvalidCiphertextException"))
+
+	plaintext, err := kmsCrypter.Decrypt(secret, myDecryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	myDecryptParams["context.service"] = "otherservice"
+	plaintext, err = kmsCrypter.Decrypt(secret, myDecryptParams)
+	assert.Error(t, err)
+	assert.Zero(t, plaintext)
+}
+
+func TestKmsEnvelope(t *testing.T) {
+	mockKMS := useMockKMS(t)
+	defer SetKMSClientFactory(nil)
+	defer mockKMS.AssertExpectations(t)
+	kmsCrypter := KMSCrypter{}
+
+	largePlaintext := strings.Repeat("0123456789", 500)
+	mockKMS.On("GenerateDataKey",
+		&kms.GenerateDataKeyInput{
+			KeyId:   aws.String("mykey"),
+			KeySpec: aws.String("AES_256"),
+			EncryptionContext: map[string]*string{
+				"service": aws.String("myservice"),
+			},
+		},
+	).Return(
+		&kms.GenerateDataKeyOutput{
+			CiphertextBlob: []byte("mywrappeddatakey"),
+			Plaintext:      []byte("0123456789abcdef0123456789abcdef"),
+		},
+		nil,
+	).Once()
+	secret, myDecryptParams, err := kmsCrypter.Encrypt(largePlaintext, map[string]string{
+		"region":          "myregion",
+		"keyID":           "mykey",
+		"context.service": "myservice",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{
+		"region":          "myregion",
+		"v":               "2",
+		"datakey":         "bXl3cmFwcGVkZGF0YWtleQ==",
+		"context.service": "myservice",
+	}, myDecryptParams)
+
+	mockKMS.On("DecryptWithContext",
+		mock.Anything,
+		&kms.DecryptInput{
+			CiphertextBlob: []byte("mywrappeddatakey"),
+			EncryptionContext: map[string]*string{
+				"service": aws.String("myservice"),
+			},
+		},
+	).Return(
+		&kms.DecryptOutput{
+			Plaintext: []byte("0123456789abcdef0123456789abcdef"),
+		},
+		nil,
+	).Once()
+	plaintext, err := kmsCrypter.Decrypt(secret, myDecryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, largePlaintext, plaintext)
+
+	delete(myDecryptParams, "datakey")
+	_, err = kmsCrypter.Decrypt(secret, myDecryptParams)
+	assert.Error(t, err)
+}
+
+func TestKmsEnvelopeForced(t *testing.T) {
+	mockKMS := useMockKMS(t)
+	defer SetKMSClientFactory(nil)
+	defer mockKMS.AssertExpectations(t)
+	kmsCrypter := KMSCrypter{}
+
+	mockKMS.On("GenerateDataKey",
+		&kms.GenerateDataKeyInput{
+			KeyId:   aws.String("mykey"),
+			KeySpec: aws.String("AES_256"),
+		},
+	).Return(
+		&kms.GenerateDataKeyOutput{
+			CiphertextBlob: []byte("mywrappeddatakey"),
+			Plaintext:      []byte("0123456789abcdef0123456789abcdef"),
+		},
+		nil,
+	).Once()
+	_, myDecryptParams, err := kmsCrypter.Encrypt("mypass", map[string]string{
+		"region":   "myregion",
+		"keyID":    "mykey",
+		"envelope": "true",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", myDecryptParams["v"])
+}
+
+func TestKmsEnvelopeDataKeyCache(t *testing.T) {
+	EnableKMSDataKeyCache(DataKeyCacheConfig{MaxAge: time.Minute})
+	defer DisableKMSDataKeyCache()
+
+	mockKMS := useMockKMS(t)
+	defer SetKMSClientFactory(nil)
+	defer mockKMS.AssertExpectations(t)
+	kmsCrypter := KMSCrypter{}
+
+	mockKMS.On("GenerateDataKey",
+		&kms.GenerateDataKeyInput{
+			KeyId:   aws.String("mykey"),
+			KeySpec: aws.String("AES_256"),
+		},
+	).Return(
+		&kms.GenerateDataKeyOutput{
+			CiphertextBlob: []byte("mywrappeddatakey"),
+			Plaintext:      []byte("0123456789abcdef0123456789abcdef"),
+		},
+		nil,
+	).Once()
+	encryptParams := map[string]string{
+		"region":   "myregion",
+		"keyID":    "mykey",
+		"envelope": "true",
+	}
+	secret, myDecryptParams, err := kmsCrypter.Encrypt("mypass", encryptParams)
+	assert.NoError(t, err)
+	secret2, myDecryptParams2, err := kmsCrypter.Encrypt("mypass2", encryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, myDecryptParams, myDecryptParams2, "data key is reused")
+
+	// forget the keys cached while encrypting
+	EnableKMSDataKeyCache(DataKeyCacheConfig{MaxAge: time.Minute})
+	mockKMS.On("DecryptWithContext",
+		mock.Anything,
+		&kms.DecryptInput{
+			CiphertextBlob: []byte("mywrappeddatakey"),
+		},
+	).Return(
+		&kms.DecryptOutput{
+			Plaintext: []byte("0123456789abcdef0123456789abcdef"),
+		},
+		nil,
+	).Once()
+	for i := 0; i < 3; i++ {
+		plaintext, err := kmsCrypter.Decrypt(secret, myDecryptParams)
+		assert.NoError(t, err)
+		assert.Equal(t, "mypass", plaintext)
+		plaintext, err = kmsCrypter.Decrypt(secret2, myDecryptParams2)
+		assert.NoError(t, err)
+		assert.Equal(t, "mypass2", plaintext)
+	}
+}
+
+func TestKMSClientFactory(t *testing.T) {
+	defer SetKMSClientFactory(nil)
+	calls := 0
+	SetKMSClientFactory(func(region string) (kmsiface.KMSAPI, error) {
+		calls++
+		if region == "badregion" {
+			return nil, fmt.Errorf("no client for %s", region)
+		}
+		return &MockKMSAPI{}, nil
+	})
+
+	client, err := kmsClient("myregion")
+	assert.NoError(t, err)
+	client2, err := kmsClient("myregion")
+	assert.NoError(t, err)
+	assert.True(t, client == client2, "client is cached")
+	assert.Equal(t, 1, calls)
+
+	ResetKMSClients()
+	client3, err := kmsClient("myregion")
+	assert.NoError(t, err)
+	assert.False(t, client == client3, "client is recreated")
+	assert.Equal(t, 2, calls)
+
+	_, err = kmsClient("badregion")
+	assert.Error(t, err)
+	_, err = KMSCrypter{}.Decrypt("Zm9v", DecryptParams{"region": "badregion"})
+	assert.EqualError(t, err, "no client for badregion")
+}
+
+func TestKmsFallbackRegions(t *testing.T) {
+	defer SetKMSClientFactory(nil)
+	mockKMSs := map[string]*MockKMSAPI{
+		"us-east-1": {},
+		"us-west-2": {},
+		"eu-west-1": {},
+	}
+	SetKMSClientFactory(func(region string) (kmsiface.KMSAPI, error) {
+		return mockKMSs[region], nil
+	})
+
+	mockKMSs["us-east-1"].On("Encrypt",
+		&kms.EncryptInput{
+			KeyId:     aws.String("mykey"),
+			Plaintext: []byte("mypass"),
+		},
+	).Return(
+		&kms.EncryptOutput{
+			CiphertextBlob: []byte("myciphertextblob"),
+		},
+		nil,
+	)
+	secret, myDecryptParams, err := KMSCrypter{}.Encrypt("mypass", map[string]string{
+		"region":          "us-east-1",
+		"keyID":           "mykey",
+		"fallbackRegions": "us-west-2,eu-west-1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "us-west-2,eu-west-1", myDecryptParams["fallback"])
+
+	decryptInput := &kms.DecryptInput{
+		CiphertextBlob: []byte("myciphertextblob"),
+	}
+	mockKMSs["us-east-1"].On("DecryptWithContext", mock.Anything, decryptInput).
+		Return(nil, fmt.Errorf("ServiceUnavailable"))
+	mockKMSs["us-west-2"].On("DecryptWithContext", mock.Anything, decryptInput).
+		Return(nil, fmt.Errorf("ServiceUnavailable")).Once()
+	mockKMSs["eu-west-1"].On("DecryptWithContext", mock.Anything, decryptInput).
+		Return(&kms.DecryptOutput{Plaintext: []byte("mypass")}, nil).Once()
+
+	plaintext, err := KMSCrypter{}.Decrypt(secret, myDecryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	mockKMSs["us-west-2"].On("DecryptWithContext", mock.Anything, decryptInput).
+		Return(nil, fmt.Errorf("AccessDenied")).Once()
+	mockKMSs["eu-west-1"].On("DecryptWithContext", mock.Anything, decryptInput).
+		Return(nil, fmt.Errorf("NotFoundException")).Once()
+	plaintext, err = KMSCrypter{}.Decrypt(secret, myDecryptParams)
+	assert.EqualError(t, err, "Error decrypting in all regions: "+
+		"us-east-1: ServiceUnavailable; us-west-2: AccessDenied; eu-west-1: NotFoundException")
+	assert.Zero(t, plaintext)
+
+	for _, mockKMS := range mockKMSs {
+		mockKMS.AssertExpectations(t)
+	}
+}
+
+func TestKmsFallbackRegionsCancelled(t *testing.T) {
+	defer SetKMSClientFactory(nil)
+	mockKMS := &MockKMSAPI{}
+	SetKMSClientFactory(func(region string) (kmsiface.KMSAPI, error) {
+		assert.Equal(t, "us-east-1", region, "fallback regions are not tried")
+		return mockKMS, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mockKMS.On("DecryptWithContext", ctx, mock.Anything).Return(nil, context.Canceled)
+	_, err := KMSCrypter{}.DecryptContext(ctx, "bXljaXBoZXJ0ZXh0YmxvYg==", DecryptParams{
+		"region":   "us-east-1",
+		"fallback": "us-west-2",
+	})
+	assert.Error(t, err)
+	mockKMS.AssertExpectations(t)
+}
+
+func TestKmsKeyID(t *testing.T) {
+	mockKMS := useMockKMS(t)
+	defer SetKMSClientFactory(nil)
+	defer mockKMS.AssertExpectations(t)
+	defer SetKMSAllowedKeys()
+	keyARN := "arn:aws:kms:myregion:123456789012:key/1234abcd"
+
+	mockKMS.On("Encrypt",
+		&kms.EncryptInput{
+			KeyId:     aws.String("alias/mykey"),
+			Plaintext: []byte("mypass"),
+		},
+	).Return(
+		&kms.EncryptOutput{
+			CiphertextBlob: []byte("myciphertextblob"),
+			KeyId:          aws.String(keyARN),
+		},
+		nil,
+	)
+	secret, myDecryptParams, err := KMSCrypter{}.Encrypt("mypass", map[string]string{
+		"region": "myregion",
+		"keyID":  "alias/mykey",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, keyARN, myDecryptParams["key"])
+
+	mockKMS.On("DecryptWithContext",
+		mock.Anything,
+		&kms.DecryptInput{
+			CiphertextBlob: []byte("myciphertextblob"),
+			KeyId:          aws.String(keyARN),
+		},
+	).Return(
+		&kms.DecryptOutput{
+			Plaintext: []byte("mypass"),
+			KeyId:     aws.String(keyARN),
+		},
+		nil,
+	)
+	plaintext, err := KMSCrypter{}.Decrypt(secret, myDecryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	SetKMSAllowedKeys(keyARN)
+	plaintext, err = KMSCrypter{}.Decrypt(secret, myDecryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	SetKMSAllowedKeys("arn:aws:kms:myregion:123456789012:key/otherkey")
+	plaintext, err = KMSCrypter{}.Decrypt(secret, myDecryptParams)
+	assert.EqualError(t, err, "KMS key '"+keyARN+"' is not allowed")
+	assert.Zero(t, plaintext)
+
+	// a secret without a recorded key is checked against the key KMS used
+	delete(myDecryptParams, "key")
+	mockKMS.On("DecryptWithContext",
+		mock.Anything,
+		&kms.DecryptInput{
+			CiphertextBlob: []byte("myciphertextblob"),
+		},
+	).Return(
+		&kms.DecryptOutput{
+			Plaintext: []byte("mypass"),
+			KeyId:     aws.String(keyARN),
+		},
+		nil,
+	)
+	plaintext, err = KMSCrypter{}.Decrypt(secret, myDecryptParams)
+	assert.EqualError(t, err, "KMS key '"+keyARN+"' is not allowed")
+	assert.Zero(t, plaintext)
+}
+
+func TestKmsMultiRegionKeyID(t *testing.T) {
+	defer SetKMSClientFactory(nil)
+	mockKMSs := map[string]*MockKMSAPI{
+		"us-east-1": {},
+		"us-west-2": {},
+	}
+	SetKMSClientFactory(func(region string) (kmsiface.KMSAPI, error) {
+		return mockKMSs[region], nil
+	})
+
+	mockKMSs["us-east-1"].On("DecryptWithContext", mock.Anything,
+		&kms.DecryptInput{
+			CiphertextBlob: []byte("myciphertextblob"),
+			KeyId:          aws.String("arn:aws:kms:us-east-1:123456789012:key/mrk-1234abcd"),
+		},
+	).Return(nil, fmt.Errorf("ServiceUnavailable"))
+	mockKMSs["us-west-2"].On("DecryptWithContext", mock.Anything,
+		&kms.DecryptInput{
+			CiphertextBlob: []byte("myciphertextblob"),
+			KeyId:          aws.String("arn:aws:kms:us-west-2:123456789012:key/mrk-1234abcd"),
+		},
+	).Return(
+		&kms.DecryptOutput{
+			Plaintext: []byte("mypass"),
+			KeyId:     aws.String("arn:aws:kms:us-west-2:123456789012:key/mrk-1234abcd"),
+		},
+		nil,
+	)
+
+	plaintext, err := KMSCrypter{}.Decrypt("bXljaXBoZXJ0ZXh0YmxvYg==", DecryptParams{
+		"region":   "us-east-1",
+		"fallback": "us-west-2",
+		"key":      "arn:aws:kms:us-east-1:123456789012:key/mrk-1234abcd",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	for _, mockKMS := range mockKMSs {
+		mockKMS.AssertExpectations(t)
+	}
+}
+
+func TestRegionalKeyARN(t *testing.T) {
+	assert.Equal(t,
+		"arn:aws:kms:eu-west-1:123456789012:key/mrk-1234abcd",
+		regionalKeyARN("arn:aws:kms:us-east-1:123456789012:key/mrk-1234abcd", "eu-west-1"),
+	)
+	assert.Equal(t,
+		"arn:aws:kms:us-east-1:123456789012:key/1234abcd",
+		regionalKeyARN("arn:aws:kms:us-east-1:123456789012:key/1234abcd", "eu-west-1"),
+		"single-Region key",
+	)
+	assert.Equal(t, "alias/mykey", regionalKeyARN("alias/mykey", "eu-west-1"))
+}
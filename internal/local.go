@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
@@ -14,6 +15,14 @@ import (
 
 type LocalCrypter struct{}
 
+// localVersion is the format of AES-GCM secrets. Version 1 secrets are
+// legacy AES-CBC.
+const localVersion = "2"
+
+// localKeySize is the size of newly generated local keys. Key files created by
+// earlier versions hold 16 byte keys, which are still accepted.
+const localKeySize = 32
+
 var keyCached []byte
 var keyCacheLock sync.RWMutex
 
@@ -33,16 +42,35 @@ func (c LocalCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ci
 	if err != nil {
 		return "", nil, fmt.Errorf("Error encrypting plaintext: %s", err)
 	}
-	return Ciphertext(ciphertext), nil, nil
+	return Ciphertext(ciphertext), withVersion(localVersion, nil), nil
 }
 
 func (c LocalCrypter) Decrypt(b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(context.Background(), c.Name(), b64ciphertext, decryptParams)
+}
+
+func (c LocalCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+		"2": c.decryptV2,
+	}
+}
+
+func (c LocalCrypter) decryptV1(ctx context.Context, b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decryptWith(AESDecryptLegacy, b64ciphertext)
+}
+
+func (c LocalCrypter) decryptV2(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decryptWith(AESDecrypt, ciphertext)
+}
+
+func (c LocalCrypter) decryptWith(aesDecrypt func([]byte, string) (string, error), b64ciphertext Ciphertext) (string, error) {
 	key, err := localKey()
 	if err != nil {
 		return "", fmt.Errorf("Error retrieving local key: %s", err)
 	}
 
-	plaintext, err := AESDecrypt(key, string(b64ciphertext))
+	plaintext, err := aesDecrypt(key, string(b64ciphertext))
 	if err != nil {
 		return "", fmt.Errorf("Error decrypting secret: %s", err)
 	}
@@ -81,11 +109,14 @@ func localKey() ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+		if len(key) != localKeySize && len(key) != 16 {
+			return nil, fmt.Errorf("Invalid key length %d in %s", len(key), keyFilePath)
+		}
 		return key, nil
 	}
 
 	// else generate the key
-	key = make([]byte, 16)
+	key = make([]byte, localKeySize)
 	_, err = rand.Read(key)
 	if err != nil {
 		return nil, err
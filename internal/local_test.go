@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"encoding/base64"
 	"io/ioutil"
 	"os"
 	"path"
@@ -26,22 +27,50 @@ func TestLocal(t *testing.T) {
 
 	localCrypter := LocalCrypter{}
 
-	secret, _, err := localCrypter.Encrypt("mypass", nil)
+	secret, decryptParams, err := localCrypter.Encrypt("mypass", nil)
 	assert.NoError(t, err)
-	secret2, _, err := localCrypter.Encrypt("mypass2", nil)
+	assert.Equal(t, DecryptParams{"v": "2"}, decryptParams)
+	secret2, decryptParams2, err := localCrypter.Encrypt("mypass2", nil)
 	assert.NoError(t, err)
 
-	plaintext, err := localCrypter.Decrypt(secret, nil)
+	plaintext, err := localCrypter.Decrypt(secret, decryptParams)
 	assert.NoError(t, err)
-	plaintext2, err := localCrypter.Decrypt(secret2, nil)
+	plaintext2, err := localCrypter.Decrypt(secret2, decryptParams2)
 	assert.NoError(t, err)
 
 	assert.Equal(t, "mypass", plaintext)
 	assert.Equal(t, "mypass2", plaintext2)
 
 	_, keyFilePath, _ := pathGetter.keyPaths()
-	_, err = os.Stat(keyFilePath)
+	keyB64, err := ioutil.ReadFile(keyFilePath)
 	assert.NoError(t, err)
+	key, err := base64.StdEncoding.DecodeString(string(keyB64))
+	assert.NoError(t, err)
+	assert.Len(t, key, 32)
+}
+
+func TestLocalKeyFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	pathGetter = tmpKeyPathGetter{tmpDir}
+	keyDir, keyFilePath, _ := pathGetter.keyPaths()
+	assert.NoError(t, os.MkdirAll(keyDir, 0755))
+
+	// key files of earlier versions hold 16 byte keys
+	assert.NoError(t, ioutil.WriteFile(keyFilePath, []byte("MDEyMzQ1Njc4OWFiY2RlZg=="), 0644))
+	localCrypter := LocalCrypter{}
+	secret, decryptParams, err := localCrypter.Encrypt("mypass", nil)
+	assert.NoError(t, err)
+	plaintext, err := localCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	assert.NoError(t, ioutil.WriteFile(keyFilePath, []byte(""), 0644))
+	_, _, err = localCrypter.Encrypt("mypass", nil)
+	assert.EqualError(t, err, "Error retrieving local key: Invalid key length 0 in "+keyFilePath)
+	_, err = localCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error retrieving local key: Invalid key length 0 in "+keyFilePath)
 }
 
 func TestLocalErrors(t *testing.T) {
@@ -52,7 +81,7 @@ func TestLocalErrors(t *testing.T) {
 
 	localCrypter := LocalCrypter{}
 
-	secret, _, err := localCrypter.Encrypt("mypass", nil)
+	secret, decryptParams, err := localCrypter.Encrypt("mypass", nil)
 	assert.NoError(t, err)
 
 	plaintext, err := localCrypter.Decrypt("@Most_certainly: NOT, Base64 !!!", nil)
@@ -65,8 +94,15 @@ func TestLocalErrors(t *testing.T) {
 	assert.Error(t, err, "too short cypher text should return error")
 	assert.Zero(t, plaintext)
 
-	plaintext, err = localCrypter.Decrypt(secret, nil)
+	plaintext, err = localCrypter.Decrypt(secret, decryptParams)
 	assert.NoError(t, err)
-
 	assert.Equal(t, "mypass", plaintext)
+
+	// secrets without a format version are legacy AES-CBC
+	plaintext, err = localCrypter.Decrypt(secret, nil)
+	assert.Error(t, err)
+	assert.Zero(t, plaintext)
+	plaintext, err = localCrypter.Decrypt(secret, DecryptParams{"v": "1"})
+	assert.Error(t, err)
+	assert.Zero(t, plaintext)
 }
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MultiCrypter encrypts secrets with a random data key that is wrapped by
+// several other crypters, e.g. kms for production and age for break-glass
+// access, so that any one of them can decrypt the secret.
+//
+// The crypters are listed in the "crypters" encrypt parameter, and the encrypt
+// parameters of each are prefixed with its name, e.g. "kms.keyID". A crypter
+// listed more than once is given an index, e.g. "kms.1" and "kms.2" with the
+// parameters "kms.1.region" and "kms.2.region". The wrapped data keys are kept
+// in the decrypt parameters under the listed names and are tried in the listed
+// order.
+type MultiCrypter struct{}
+
+const multiVersion = "1"
+
+// multiCryptersParam lists the wrapping crypters in both the encrypt and the
+// decrypt parameters.
+const multiCryptersParam = "crypters"
+
+const multiDataKeySize = 32
+
+// nestedCrypterIndex matches the index that tells apart entries of the same
+// crypter in the crypters list of a composite crypter, e.g. the 2 of "age.2".
+var nestedCrypterIndex = regexp.MustCompile(`^[1-9][0-9]*$`)
+
+// nestedCrypter returns the crypter of an entry in the crypters list of a
+// composite crypter: a crypter name, optionally followed by a dot and an
+// index.
+func nestedCrypter(entry string) (Crypter, bool) {
+	name := entry
+	if i := strings.Index(entry, "."); i >= 0 {
+		if !nestedCrypterIndex.MatchString(entry[i+1:]) {
+			return nil, false
+		}
+		name = entry[:i]
+	}
+	if name == multiCryptersParam || name == shamirThresholdParam || name == VersionParam {
+		return nil, false
+	}
+	return GetCrypter(name)
+}
+
+// nestedCrypterNames parses the comma separated list of crypters that wrap
+// the data key, or its shares, of a composite crypter.
+func nestedCrypterNames(outer string, names string) ([]string, error) {
+	var crypterNames []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		crypter, ok := nestedCrypter(name)
+		if !ok {
+			return nil, fmt.Errorf("Invalid crypter name '%s'", name)
+		}
+		if seen[name] && !strings.Contains(name, ".") {
+			return nil, fmt.Errorf("Crypter '%s' is listed more than once, give each an index, e.g. '%s.1'", name, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Crypter '%s' is listed more than once", name)
+		}
+		switch crypter.(type) {
+		case MultiCrypter, ShamirCrypter:
+			return nil, fmt.Errorf("Crypter '%s' cannot be nested in %s", name, outer)
+		}
+		seen[name] = true
+		crypterNames = append(crypterNames, name)
+	}
+	if len(crypterNames) == 0 {
+		return nil, fmt.Errorf("Missing %s parameter!", multiCryptersParam)
+	}
+	return crypterNames, nil
+}
+
+// isPlainCrypter tells whether the listed crypter stores plaintexts as they
+// are, so that keys wrapped by it would not be protected at all.
+func isPlainCrypter(name string) bool {
+	crypter, _ := nestedCrypter(name)
+	_, plain := crypter.(PlainCrypter)
+	return plain
+}
+
+// nestedEncryptParams returns the encrypt parameters prefixed with the listed
+// crypter name, without the prefix. The parameters of indexed entries of the
+// same crypter, e.g. "age.1.recipients" for "age", are left out.
+func nestedEncryptParams(name string, encryptParams EncryptParams) EncryptParams {
+	params := make(EncryptParams)
+	prefix := name + "."
+	for key, value := range encryptParams {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		key = strings.TrimPrefix(key, prefix)
+		if i := strings.Index(key, "."); i >= 0 && nestedCrypterIndex.MatchString(key[:i]) {
+			continue
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// wrapKey encrypts the key with the listed crypter. The result holds the
+// crypter's decrypt parameters and ciphertext, like a secret without the
+// crypter name.
+func wrapKey(name string, key []byte, encryptParams EncryptParams) (string, error) {
+	crypter, ok := nestedCrypter(name)
+	if !ok {
+		return "", fmt.Errorf("Invalid crypter name '%s'", name)
+	}
+	ciphertext, decryptParams, err := crypter.Encrypt(base64.StdEncoding.EncodeToString(key), encryptParams)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", name, err)
+	}
+	return UnparseDecryptParams(decryptParams) + ":" + string(ciphertext), nil
+}
+
+// unwrapKey decrypts a key wrapped by wrapKey.
+func unwrapKey(ctx context.Context, name string, wrappedKey string) ([]byte, error) {
+	crypter, ok := nestedCrypter(name)
+	if !ok {
+		return nil, fmt.Errorf("Invalid crypter name '%s'", name)
+	}
+	tokens := strings.SplitN(wrappedKey, ":", 2)
+	if len(tokens) < 2 {
+		return nil, fmt.Errorf("Malformed wrapped key")
+	}
+	decryptParams, err := ParseDecryptParams(tokens[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid decryption parameters of wrapped key: %s", err)
+	}
+	encodedKey, err := DecryptContext(ctx, crypter, Ciphertext(tokens[1]), decryptParams)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("Wrapped key is not valid base64")
+	}
+	return key, nil
+}
+
+func (c MultiCrypter) Name() string {
+	return "multi"
+}
+
+func (c MultiCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	crypterNames, err := nestedCrypterNames(c.Name(), encryptParams[multiCryptersParam])
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+	for _, name := range crypterNames {
+		if isPlainCrypter(name) {
+			return Ciphertext(""), nil, fmt.Errorf("Crypter '%s' cannot be used in multi, it would leave the data key unencrypted", name)
+		}
+	}
+
+	dataKey := make([]byte, multiDataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error generating data key: %s", err)
+	}
+	defer wipe(dataKey)
+
+	decryptParams := DecryptParams{multiCryptersParam: strings.Join(crypterNames, ",")}
+	for _, name := range crypterNames {
+		wrappedKey, err := wrapKey(name, dataKey, nestedEncryptParams(name, encryptParams))
+		if err != nil {
+			return Ciphertext(""), nil, fmt.Errorf("Error wrapping data key: %s", err)
+		}
+		decryptParams[name] = wrappedKey
+	}
+
+	ciphertext, err := AESEncrypt(dataKey, plaintext)
+	if err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+	return Ciphertext(ciphertext), withVersion(multiVersion, decryptParams), nil
+}
+
+func (c MultiCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.DecryptContext(context.Background(), ciphertext, decryptParams)
+}
+
+func (c MultiCrypter) DecryptContext(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(ctx, c.Name(), ciphertext, decryptParams)
+}
+
+func (c MultiCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c MultiCrypter) decryptV1(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	if decryptParams[multiCryptersParam] == "" {
+		return "", fmt.Errorf("Missing %s parameter!", multiCryptersParam)
+	}
+
+	var failures []string
+	for _, name := range strings.Split(decryptParams[multiCryptersParam], ",") {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		dataKey, err := unwrapKey(ctx, name, decryptParams[name])
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		plaintext, err := AESDecrypt(dataKey, string(ciphertext))
+		wipe(dataKey)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		return plaintext, nil
+	}
+	return "", fmt.Errorf("Error decrypting secret, no crypter could unwrap the data key: %s", strings.Join(failures, "; "))
+}
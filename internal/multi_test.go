@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+// wrapperFixture sets up the age and password crypters for the tests of
+// multi and shamir: an age identity written to a file, which is not
+// configured yet, and a password provider counting its prompts.
+type wrapperFixture struct {
+	identity     *age.X25519Identity
+	identityFile string
+	password     string
+	prompts      int
+}
+
+func newWrapperFixture(t *testing.T) *wrapperFixture {
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	f := &wrapperFixture{
+		identity:     identity,
+		identityFile: writeAgeIdentityFile(t, identity),
+		password:     "mypass",
+	}
+	SetPasswordProvider(PasswordProviderFunc(func() ([]byte, error) {
+		f.prompts++
+		return []byte(f.password), nil
+	}))
+	return f
+}
+
+func (f *wrapperFixture) close() {
+	SetAgeIdentityFile("")
+	SetPasswordProvider(nil)
+	os.Remove(f.identityFile)
+}
+
+func TestMulti(t *testing.T) {
+	f := newWrapperFixture(t)
+	defer f.close()
+
+	multiCrypter := MultiCrypter{}
+	secret, decryptParams, err := multiCrypter.Encrypt("myplaintext", EncryptParams{
+		"crypters":         "age, password",
+		"age.recipients":   f.identity.Recipient().String(),
+		"password.scryptN": "1024",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "age,password", decryptParams["crypters"])
+	assert.Equal(t, "1", decryptParams["v"])
+	assert.Contains(t, decryptParams["age"], "v=1:")
+	assert.Contains(t, decryptParams["password"], "N=1024&")
+	f.prompts = 0
+
+	// the first crypter that works decrypts the secret
+	SetAgeIdentityFile(f.identityFile)
+	plaintext, err := multiCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+	assert.Equal(t, 0, f.prompts)
+
+	SetAgeIdentityFile("")
+	plaintext, err = multiCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+	assert.Equal(t, 1, f.prompts)
+
+	f.password = "notmypass"
+	_, err = multiCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret, no crypter could unwrap the data key: "+
+		"age: No age identity file, set SECRETCRYPT_AGE_IDENTITY_FILE or configure the identity file; "+
+		"password: Error decrypting secret: Ciphertext failed authentication")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = multiCrypter.DecryptContext(ctx, secret, decryptParams)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestMultiEncryptErrors(t *testing.T) {
+	multiCrypter := MultiCrypter{}
+	for _, tc := range []struct {
+		crypters string
+		err      string
+	}{
+		{"", "Missing crypters parameter!"},
+		{"age,nosuchcrypter", "Invalid crypter name 'nosuchcrypter'"},
+		{"age,age", "Crypter 'age' is listed more than once, give each an index, e.g. 'age.1'"},
+		{"age.1,age.1", "Crypter 'age.1' is listed more than once"},
+		{"age.0", "Invalid crypter name 'age.0'"},
+		{"age.one", "Invalid crypter name 'age.one'"},
+		{"age.1.2", "Invalid crypter name 'age.1.2'"},
+		{"crypters.1", "Invalid crypter name 'crypters.1'"},
+		{"age,multi.1", "Crypter 'multi.1' cannot be nested in multi"},
+		{"age,plain.1", "Crypter 'plain.1' cannot be used in multi, it would leave the data key unencrypted"},
+		{"age,multi", "Crypter 'multi' cannot be nested in multi"},
+		{"age,plain", "Crypter 'plain' cannot be used in multi, it would leave the data key unencrypted"},
+		{"age", "Error wrapping data key: age: Missing recipients parameter!"},
+	} {
+		_, _, err := multiCrypter.Encrypt("myplaintext", EncryptParams{"crypters": tc.crypters})
+		assert.EqualError(t, err, tc.err, tc.crypters)
+	}
+}
+
+func TestMultiIndexed(t *testing.T) {
+	defer resetAWSConfigs()
+	fakeAWSConfig := func(endpoint string) AWSConfig {
+		return AWSConfig{
+			Config: aws.NewConfig().
+				WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")).
+				WithMaxRetries(0),
+			Endpoint: endpoint,
+		}
+	}
+	for _, region := range []string{"us-east-1", "eu-west-1"} {
+		fake := newFakeKMS(region)
+		defer fake.Close()
+		SetRegionAWSConfig(region, fakeAWSConfig(fake.URL))
+	}
+
+	// the same crypter wraps the data key twice, with keys in two regions
+	multiCrypter := MultiCrypter{}
+	secret, decryptParams, err := multiCrypter.Encrypt("myplaintext", EncryptParams{
+		"crypters":     "kms.1,kms.2",
+		"kms.1.region": "us-east-1",
+		"kms.1.keyID":  "alias/mykey",
+		"kms.2.region": "eu-west-1",
+		"kms.2.keyID":  "alias/mykey",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "kms.1,kms.2", decryptParams["crypters"])
+	assert.Contains(t, decryptParams["kms.1"], "region=us-east-1")
+	assert.Contains(t, decryptParams["kms.2"], "region=eu-west-1")
+
+	plaintext, err := multiCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+
+	// the second region decrypts when the first is unavailable
+	SetRegionAWSConfig("us-east-1", fakeAWSConfig("http://127.0.0.1:1"))
+	plaintext, err = multiCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+}
+
+func TestNestedEncryptParams(t *testing.T) {
+	encryptParams := EncryptParams{
+		"crypters":         "age,age.1,kms",
+		"age.recipients":   "age1a",
+		"age.1.recipients": "age1b",
+		"kms.keyID":        "alias/mykey",
+	}
+	assert.Equal(t, EncryptParams{"recipients": "age1a"}, nestedEncryptParams("age", encryptParams))
+	assert.Equal(t, EncryptParams{"recipients": "age1b"}, nestedEncryptParams("age.1", encryptParams))
+	assert.Equal(t, EncryptParams{"keyID": "alias/mykey"}, nestedEncryptParams("kms", encryptParams))
+}
+
+func TestMultiTampered(t *testing.T) {
+	f := newWrapperFixture(t)
+	defer f.close()
+	SetAgeIdentityFile(f.identityFile)
+	encryptParams := EncryptParams{"crypters": "age", "age.recipients": f.identity.Recipient().String()}
+
+	multiCrypter := MultiCrypter{}
+	secret, decryptParams, err := multiCrypter.Encrypt("myplaintext", encryptParams)
+	assert.NoError(t, err)
+
+	plaintext, err := multiCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+
+	_, otherParams, err := multiCrypter.Encrypt("myplaintext", encryptParams)
+	assert.NoError(t, err)
+	_, err = multiCrypter.Decrypt(secret, otherParams)
+	assert.EqualError(t, err, "Error decrypting secret, no crypter could unwrap the data key: age: Ciphertext failed authentication")
+
+	delete(decryptParams, "age")
+	_, err = multiCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret, no crypter could unwrap the data key: age: Malformed wrapped key")
+}
@@ -1,18 +1,21 @@
 package internal
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
-	"golang.org/x/crypto/scrypt"
-	"golang.org/x/crypto/ssh/terminal"
-	"syscall"
 )
 
 type PasswordCrypter struct {
-	readPassword func(int) ([]byte, error)
+	passwordProvider PasswordProvider
 }
 
+// passwordVersion is the format of AES-GCM secrets recording their key
+// derivation parameters. Version 1 secrets are legacy AES-CBC with the legacy
+// scrypt parameters.
+const passwordVersion = "2"
+
 func (c PasswordCrypter) Name() string {
 	return "password"
 }
@@ -24,7 +27,12 @@ func (c PasswordCrypter) Encrypt(plaintext string, encryptParams EncryptParams)
 		return "", nil, fmt.Errorf("Error generating salt: %s", err)
 	}
 	salt := base64.StdEncoding.EncodeToString(rawSalt)
-	key, err := c.getKey([]byte(salt))
+	kdf, err := passwordKDFFromEncryptParams(encryptParams)
+	if err != nil {
+		return "", nil, err
+	}
+	passwordID := encryptParams["passwordID"]
+	key, err := c.getKey(kdf, []byte(salt), passwordID)
 	if err != nil {
 		return "", nil, fmt.Errorf("Error generating encryption key: %s", err)
 	}
@@ -33,36 +41,72 @@ func (c PasswordCrypter) Encrypt(plaintext string, encryptParams EncryptParams)
 	if err != nil {
 		return "", nil, fmt.Errorf("Error encrypting plaintext: %s", err)
 	}
-	decryptParams := DecryptParams{"salt": string(salt)}
-	return Ciphertext(ciphertext), decryptParams, nil
+	decryptParams := kdf.decryptParams()
+	decryptParams["salt"] = salt
+	if passwordID != "" {
+		decryptParams["pwid"] = passwordID
+	}
+	return Ciphertext(ciphertext), withVersion(passwordVersion, decryptParams), nil
 }
 
 func (c PasswordCrypter) Decrypt(b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(context.Background(), c.Name(), b64ciphertext, decryptParams)
+}
+
+func (c PasswordCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+		"2": c.decryptV2,
+	}
+}
+
+// decryptV1 decrypts AES-CBC secrets derived with the legacy scrypt
+// parameters, which are not recorded in the secret.
+func (c PasswordCrypter) decryptV1(ctx context.Context, b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decryptWithKDF(legacyScryptParams, AESDecryptLegacy, b64ciphertext, decryptParams)
+}
+
+// decryptV2 decrypts AES-GCM secrets whose key derivation parameters are
+// recorded in the decrypt params.
+func (c PasswordCrypter) decryptV2(ctx context.Context, b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	kdf, err := parsePasswordKDF(decryptParams)
+	if err != nil {
+		return "", err
+	}
+	return c.decryptWithKDF(kdf, AESDecrypt, b64ciphertext, decryptParams)
+}
+
+func (c PasswordCrypter) decryptWithKDF(kdf passwordKDF, aesDecrypt func([]byte, string) (string, error), b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
 	salt, ok := decryptParams["salt"]
 	if !ok {
 		return "", fmt.Errorf("Missing salt!")
 	}
-	key, err := c.getKey([]byte(salt))
+	passwordID := decryptParams["pwid"]
+	key, err := c.getKey(kdf, []byte(salt), passwordID)
 	if err != nil {
 		return "", fmt.Errorf("Error retrieving encryption key: %s", err)
 	}
 
-	plaintext, err := AESDecrypt(key, string(b64ciphertext))
+	plaintext, err := aesDecrypt(key, string(b64ciphertext))
 	if err != nil {
+		if err == ErrCiphertextAuthentication && passwordID != "" {
+			// the cached password, if any, is wrong
+			forgetPassword(passwordID)
+		}
 		return "", fmt.Errorf("Error decrypting secret: %s", err)
 	}
 	return string(plaintext), nil
 }
 
-func (c PasswordCrypter) getKey(salt []byte) ([]byte, error) {
-	if c.readPassword == nil {
-		c.readPassword = terminal.ReadPassword
+func (c PasswordCrypter) getKey(kdf passwordKDF, salt []byte, passwordID string) ([]byte, error) {
+	provider := c.passwordProvider
+	if provider == nil {
+		provider = currentPasswordProvider()
 	}
-	fmt.Print("Enter password: ")
-	password, err := c.readPassword(int(syscall.Stdin))
-	fmt.Print("\n")
+	password, err := cachedPassword(passwordID, provider)
 	if err != nil {
 		return []byte(nil), fmt.Errorf("Error reading password: %s", err)
 	}
-	return scrypt.Key([]byte(password), salt, 1024, 1, 1, 24)
+	defer wipe(password)
+	return kdf.deriveKey(password, salt)
 }
@@ -0,0 +1,94 @@
+package internal
+
+import "sync"
+
+var passwordCachingEnabled bool
+var passwordCache = make(map[string][]byte)
+var passwordCacheLock sync.Mutex
+
+// passwordPromptLocks serialize asking for the password of each ID, without
+// holding passwordCacheLock while the provider prompts.
+var passwordPromptLocks = make(map[string]*sync.Mutex)
+
+// SetPasswordCaching enables or disables caching of passwords for the lifetime
+// of the process. Cached passwords are keyed by the password ID stored in a
+// secret's decrypt params, so secrets without one are never cached.
+// Disabling caching also forgets all cached passwords.
+func SetPasswordCaching(enabled bool) {
+	passwordCacheLock.Lock()
+	defer passwordCacheLock.Unlock()
+	passwordCachingEnabled = enabled
+	if !enabled {
+		forgetPasswordsLocked()
+	}
+}
+
+// ForgetPasswords wipes all cached passwords.
+func ForgetPasswords() {
+	passwordCacheLock.Lock()
+	defer passwordCacheLock.Unlock()
+	forgetPasswordsLocked()
+}
+
+func forgetPasswordsLocked() {
+	for passwordID := range passwordCache {
+		forgetPasswordLocked(passwordID)
+	}
+}
+
+func forgetPassword(passwordID string) {
+	passwordCacheLock.Lock()
+	defer passwordCacheLock.Unlock()
+	forgetPasswordLocked(passwordID)
+}
+
+func forgetPasswordLocked(passwordID string) {
+	wipe(passwordCache[passwordID])
+	delete(passwordCache, passwordID)
+}
+
+// cachedPassword returns a copy of the cached password for the ID, which the
+// caller wipes, asking the provider for it if it is not cached yet.
+// Concurrent decryptions with the same ID prompt only once, while other
+// decryptions and ForgetPasswords do not wait for the prompt.
+func cachedPassword(passwordID string, provider PasswordProvider) ([]byte, error) {
+	passwordCacheLock.Lock()
+	if !passwordCachingEnabled || passwordID == "" {
+		passwordCacheLock.Unlock()
+		return provider.Password()
+	}
+	if password, exists := passwordCache[passwordID]; exists {
+		defer passwordCacheLock.Unlock()
+		return append([]byte(nil), password...), nil
+	}
+	promptLock, exists := passwordPromptLocks[passwordID]
+	if !exists {
+		promptLock = &sync.Mutex{}
+		passwordPromptLocks[passwordID] = promptLock
+	}
+	passwordCacheLock.Unlock()
+
+	promptLock.Lock()
+	defer promptLock.Unlock()
+	passwordCacheLock.Lock()
+	password, exists := passwordCache[passwordID]
+	if exists {
+		// cached while waiting for another prompt
+		password = append([]byte(nil), password...)
+	}
+	passwordCacheLock.Unlock()
+	if exists {
+		return password, nil
+	}
+
+	password, err := provider.Password()
+	if err != nil {
+		return nil, err
+	}
+	passwordCacheLock.Lock()
+	defer passwordCacheLock.Unlock()
+	if passwordCachingEnabled {
+		passwordCache[passwordID] = append([]byte(nil), password...)
+	}
+	return password, nil
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// PasswordProvider supplies the password used by the password crypter. The
+// crypter wipes the returned slice once it has derived the key.
+type PasswordProvider interface {
+	Password() ([]byte, error)
+}
+
+var passwordProvider PasswordProvider = TerminalPasswordProvider{}
+var passwordProviderLock sync.RWMutex
+
+// SetPasswordProvider sets the provider used by the password crypter. Passing
+// nil restores the default interactive terminal prompt.
+func SetPasswordProvider(provider PasswordProvider) {
+	if provider == nil {
+		provider = TerminalPasswordProvider{}
+	}
+	passwordProviderLock.Lock()
+	defer passwordProviderLock.Unlock()
+	passwordProvider = provider
+}
+
+func currentPasswordProvider() PasswordProvider {
+	passwordProviderLock.RLock()
+	defer passwordProviderLock.RUnlock()
+	return passwordProvider
+}
+
+// TerminalPasswordProvider interactively prompts for the password on the
+// terminal.
+type TerminalPasswordProvider struct {
+	readPassword func(int) ([]byte, error)
+}
+
+func (p TerminalPasswordProvider) Password() ([]byte, error) {
+	readPassword := p.readPassword
+	if readPassword == nil {
+		readPassword = terminal.ReadPassword
+	}
+	fmt.Fprint(os.Stderr, "Enter password: ")
+	password, err := readPassword(int(syscall.Stdin))
+	fmt.Fprint(os.Stderr, "\n")
+	return password, err
+}
+
+// EnvPasswordProvider reads the password from the named environment variable.
+type EnvPasswordProvider struct {
+	Name string
+}
+
+func (p EnvPasswordProvider) Password() ([]byte, error) {
+	password, ok := os.LookupEnv(p.Name)
+	if !ok {
+		return nil, fmt.Errorf("Environment variable %s is not set", p.Name)
+	}
+	return []byte(password), nil
+}
+
+// FilePasswordProvider reads the password from a file, such as a mounted
+// Docker or Kubernetes secret. A trailing newline is ignored.
+type FilePasswordProvider struct {
+	Path string
+}
+
+func (p FilePasswordProvider) Password() ([]byte, error) {
+	password, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return trimNewline(password), nil
+}
+
+// CommandPasswordProvider runs a command and uses its standard output as the
+// password. A trailing newline is ignored.
+type CommandPasswordProvider struct {
+	Name string
+	Args []string
+}
+
+func (p CommandPasswordProvider) Password() ([]byte, error) {
+	cmd := exec.Command(p.Name, p.Args...)
+	cmd.Stderr = os.Stderr
+	password, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Error running password command %s: %s", p.Name, err)
+	}
+	return trimNewline(password), nil
+}
+
+// PasswordProviderFunc adapts an ordinary function to a PasswordProvider.
+type PasswordProviderFunc func() ([]byte, error)
+
+func (f PasswordProviderFunc) Password() ([]byte, error) {
+	return f()
+}
+
+func trimNewline(password []byte) []byte {
+	password = bytes.TrimSuffix(password, []byte("\n"))
+	return bytes.TrimSuffix(password, []byte("\r"))
+}
@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -8,8 +11,10 @@ import (
 
 func TestPassword(t *testing.T) {
 	crypter := PasswordCrypter{
-		readPassword: func(fd int) ([]byte, error) {
-			return []byte("mypass"), nil
+		passwordProvider: TerminalPasswordProvider{
+			readPassword: func(fd int) ([]byte, error) {
+				return []byte("mypass"), nil
+			},
 		},
 	}
 
@@ -21,3 +26,353 @@ func TestPassword(t *testing.T) {
 
 	assert.Equal(t, "myplaintext", plaintext)
 }
+
+func TestPasswordLegacySecret(t *testing.T) {
+	crypter := PasswordCrypter{
+		passwordProvider: PasswordProviderFunc(func() ([]byte, error) {
+			return []byte("mypass"), nil
+		}),
+	}
+
+	// encrypted before scrypt parameters and format versions were recorded
+	decryptParams, err := ParseDecryptParams("salt=hjMZwWWm6VfDXJ5xpUTyuQ%3D%3D")
+	assert.NoError(t, err)
+	plaintext, err := crypter.Decrypt("fIsnQLW6aCMrk+pRpfjLVtC57JE62A5idKYDiL5aDkY=", decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+
+	// version 1 secrets are always AES-CBC
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", EncryptParams{"scryptN": "1024"})
+	assert.NoError(t, err)
+	decryptParams["v"] = "1"
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err)
+}
+
+func TestPasswordScryptParams(t *testing.T) {
+	crypter := PasswordCrypter{
+		passwordProvider: PasswordProviderFunc(func() ([]byte, error) {
+			return []byte("mypass"), nil
+		}),
+	}
+
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "2", decryptParams["v"])
+	assert.Equal(t, "scrypt", decryptParams["kdf"])
+	assert.Equal(t, "32768", decryptParams["N"])
+	assert.Equal(t, "8", decryptParams["r"])
+	assert.Equal(t, "1", decryptParams["p"])
+	assert.Equal(t, "32", decryptParams["keylen"])
+
+	secret, decryptParams, err = crypter.Encrypt("myplaintext", EncryptParams{
+		"scryptN": "2048",
+		"scryptR": "4",
+		"scryptP": "2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "2048", decryptParams["N"])
+	assert.Equal(t, "4", decryptParams["r"])
+	assert.Equal(t, "2", decryptParams["p"])
+	plaintext, err := crypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+
+	decryptParams["N"] = "4096"
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err, "secret encrypted with different parameters")
+
+	decryptParams["N"] = "1000"
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err, "N not a power of 2")
+
+	delete(decryptParams, "N")
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err, "missing N")
+
+	_, _, err = crypter.Encrypt("myplaintext", EncryptParams{"scryptN": "abc"})
+	assert.Error(t, err)
+	_, _, err = crypter.Encrypt("myplaintext", EncryptParams{"scryptN": "1073741824"})
+	assert.Error(t, err, "N too large")
+}
+
+func TestPasswordScryptParamsBounds(t *testing.T) {
+	for _, params := range []DecryptParams{
+		{"N": "2", "r": "536870912", "p": "1"},
+		{"N": "2", "r": "33", "p": "1"},
+		{"N": "1024", "r": "1", "p": "17"},
+		{"N": "1024", "r": "0", "p": "1"},
+		{"N": "4194304", "r": "16", "p": "1"},
+	} {
+		params["kdf"] = "scrypt"
+		params["keylen"] = "32"
+		_, err := parsePasswordKDF(params)
+		assert.Error(t, err, "%v", params)
+	}
+
+	kdf, err := parsePasswordKDF(DecryptParams{"kdf": "scrypt", "N": "4194304", "r": "8", "p": "16", "keylen": "32"})
+	assert.NoError(t, err)
+	assert.Equal(t, ScryptParams{N: 1 << 22, R: 8, P: 16, KeyLen: 32}, kdf)
+
+	crypter := PasswordCrypter{
+		passwordProvider: PasswordProviderFunc(func() ([]byte, error) {
+			return []byte("mypass"), nil
+		}),
+	}
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", EncryptParams{"scryptN": "1024"})
+	assert.NoError(t, err)
+	decryptParams["N"] = "2"
+	decryptParams["r"] = "536870912"
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid scrypt parameters r=536870912, p=1")
+}
+
+func TestPasswordArgon2id(t *testing.T) {
+	crypter := PasswordCrypter{
+		passwordProvider: PasswordProviderFunc(func() ([]byte, error) {
+			return []byte("mypass"), nil
+		}),
+	}
+
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", EncryptParams{"kdf": "argon2id"})
+	assert.NoError(t, err)
+	assert.Equal(t, "argon2id", decryptParams["kdf"])
+	assert.Equal(t, "65536", decryptParams["m"])
+	assert.Equal(t, "3", decryptParams["t"])
+	assert.Equal(t, "4", decryptParams["p"])
+	assert.Equal(t, "32", decryptParams["keylen"])
+	plaintext, err := crypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+
+	secret, decryptParams, err = crypter.Encrypt("myplaintext", EncryptParams{
+		"kdf":               "argon2id",
+		"argon2Memory":      "1024",
+		"argon2Iterations":  "1",
+		"argon2Parallelism": "2",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1024", decryptParams["m"])
+	plaintext, err = crypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+
+	decryptParams["kdf"] = "scrypt"
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err, "wrong kdf")
+
+	decryptParams["kdf"] = "argon2id"
+	decryptParams["m"] = "4294967296"
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err, "memory too large")
+
+	_, _, err = crypter.Encrypt("myplaintext", EncryptParams{"kdf": "argon2id", "argon2Parallelism": "0"})
+	assert.Error(t, err)
+	_, _, err = crypter.Encrypt("myplaintext", EncryptParams{"kdf": "bcrypt"})
+	assert.Error(t, err)
+}
+
+func TestPasswordWrongPassword(t *testing.T) {
+	crypter := PasswordCrypter{
+		passwordProvider: PasswordProviderFunc(func() ([]byte, error) {
+			return []byte("mypass"), nil
+		}),
+	}
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", nil)
+	assert.NoError(t, err)
+
+	crypter.passwordProvider = PasswordProviderFunc(func() ([]byte, error) {
+		return []byte("notmypass"), nil
+	})
+	plaintext, err := crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err)
+	assert.Zero(t, plaintext)
+}
+
+func TestPasswordGlobalProvider(t *testing.T) {
+	SetPasswordProvider(PasswordProviderFunc(func() ([]byte, error) {
+		return []byte("mypass"), nil
+	}))
+	defer SetPasswordProvider(nil)
+
+	crypter := PasswordCrypter{}
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", nil)
+	assert.NoError(t, err)
+
+	plaintext, err := crypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+}
+
+func TestEnvPasswordProvider(t *testing.T) {
+	os.Setenv("SECRETCRYPT_TEST_PASSWORD", "mypass")
+	defer os.Unsetenv("SECRETCRYPT_TEST_PASSWORD")
+
+	password, err := EnvPasswordProvider{"SECRETCRYPT_TEST_PASSWORD"}.Password()
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", string(password))
+
+	_, err = EnvPasswordProvider{"SECRETCRYPT_TEST_UNSET_PASSWORD"}.Password()
+	assert.Error(t, err)
+}
+
+func TestFilePasswordProvider(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	passwordFile := path.Join(tmpDir, "password")
+	assert.NoError(t, ioutil.WriteFile(passwordFile, []byte("mypass\n"), 0600))
+
+	password, err := FilePasswordProvider{passwordFile}.Password()
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", string(password))
+
+	_, err = FilePasswordProvider{path.Join(tmpDir, "missing")}.Password()
+	assert.Error(t, err)
+}
+
+func TestCommandPasswordProvider(t *testing.T) {
+	password, err := CommandPasswordProvider{"echo", []string{"mypass"}}.Password()
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", string(password))
+
+	_, err = CommandPasswordProvider{"false", nil}.Password()
+	assert.Error(t, err)
+}
+
+func TestPasswordCaching(t *testing.T) {
+	SetPasswordCaching(true)
+	defer SetPasswordCaching(false)
+
+	prompts := 0
+	crypter := PasswordCrypter{
+		passwordProvider: PasswordProviderFunc(func() ([]byte, error) {
+			prompts++
+			return []byte("mypass"), nil
+		}),
+	}
+
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", EncryptParams{"passwordID": "team"})
+	assert.NoError(t, err)
+	assert.Equal(t, "team", decryptParams["pwid"])
+	secret2, decryptParams2, err := crypter.Encrypt("myplaintext2", EncryptParams{"passwordID": "team"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, prompts)
+
+	for i := 0; i < 3; i++ {
+		plaintext, err := crypter.Decrypt(secret, decryptParams)
+		assert.NoError(t, err)
+		assert.Equal(t, "myplaintext", plaintext)
+		plaintext, err = crypter.Decrypt(secret2, decryptParams2)
+		assert.NoError(t, err)
+		assert.Equal(t, "myplaintext2", plaintext)
+	}
+	assert.Equal(t, 1, prompts)
+
+	ForgetPasswords()
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, prompts)
+}
+
+func TestPasswordCachingCopies(t *testing.T) {
+	SetPasswordCaching(true)
+	defer SetPasswordCaching(false)
+	provider := PasswordProviderFunc(func() ([]byte, error) {
+		return []byte("mypass"), nil
+	})
+
+	password, err := cachedPassword("team", provider)
+	assert.NoError(t, err)
+	wipe(password)
+	cached, err := cachedPassword("team", provider)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("mypass"), cached)
+
+	ForgetPasswords()
+	assert.Equal(t, []byte("mypass"), cached)
+}
+
+func TestPasswordCachingPromptsWithoutLock(t *testing.T) {
+	SetPasswordCaching(true)
+	defer SetPasswordCaching(false)
+	prompting := make(chan struct{})
+	answer := make(chan struct{})
+	prompts := 0
+	blocking := PasswordProviderFunc(func() ([]byte, error) {
+		prompts++
+		close(prompting)
+		<-answer
+		return []byte("mypass"), nil
+	})
+
+	done := make(chan []byte)
+	for i := 0; i < 2; i++ {
+		go func() {
+			password, err := cachedPassword("team", blocking)
+			assert.NoError(t, err)
+			done <- password
+		}()
+	}
+	<-prompting
+
+	// other IDs and forgetting are not blocked by the prompt
+	password, err := cachedPassword("other", PasswordProviderFunc(func() ([]byte, error) {
+		return []byte("otherpass"), nil
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("otherpass"), password)
+	ForgetPasswords()
+
+	close(answer)
+	assert.Equal(t, []byte("mypass"), <-done)
+	assert.Equal(t, []byte("mypass"), <-done)
+	assert.Equal(t, 1, prompts)
+}
+
+func TestPasswordCachingWithoutID(t *testing.T) {
+	SetPasswordCaching(true)
+	defer SetPasswordCaching(false)
+
+	prompts := 0
+	crypter := PasswordCrypter{
+		passwordProvider: PasswordProviderFunc(func() ([]byte, error) {
+			prompts++
+			return []byte("mypass"), nil
+		}),
+	}
+
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, decryptParams, "pwid")
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, prompts)
+}
+
+func TestPasswordCachingForgetsWrongPassword(t *testing.T) {
+	SetPasswordCaching(true)
+	defer SetPasswordCaching(false)
+
+	password := "mypass"
+	crypter := PasswordCrypter{
+		passwordProvider: PasswordProviderFunc(func() ([]byte, error) {
+			return []byte(password), nil
+		}),
+	}
+	secret, decryptParams, err := crypter.Encrypt("myplaintext", EncryptParams{"passwordID": "team"})
+	assert.NoError(t, err)
+
+	ForgetPasswords()
+	password = "notmypass"
+	_, err = crypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err)
+
+	password = "mypass"
+	plaintext, err := crypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// PGPCrypter encrypts secrets to one or more OpenPGP public keys. Decryption
+// only accepts integrity protected messages encrypted to the keys recorded
+// in the "recipients" decrypt parameter.
+type PGPCrypter struct{}
+
+const pgpVersion = "1"
+
+// PGPKeyringEnv names the environment variable holding the path of the
+// OpenPGP keyring used by the pgp crypter.
+const PGPKeyringEnv = "SECRETCRYPT_PGP_KEYRING"
+
+var pgpKeyring string
+var pgpPassphraseProvider PasswordProvider = TerminalPasswordProvider{}
+var pgpLock sync.RWMutex
+
+// SetPGPKeyring sets the path of the OpenPGP keyring, armored or binary, that
+// holds the recipients' public keys when encrypting and the private keys when
+// decrypting. It takes precedence over the SECRETCRYPT_PGP_KEYRING
+// environment variable. Passing "" removes the override.
+func SetPGPKeyring(path string) {
+	pgpLock.Lock()
+	defer pgpLock.Unlock()
+	pgpKeyring = path
+}
+
+// SetPGPPassphraseProvider sets the provider of the passphrase protecting the
+// private keys. Passing nil restores the default interactive terminal
+// prompt.
+func SetPGPPassphraseProvider(provider PasswordProvider) {
+	if provider == nil {
+		provider = TerminalPasswordProvider{}
+	}
+	pgpLock.Lock()
+	defer pgpLock.Unlock()
+	pgpPassphraseProvider = provider
+}
+
+// readPGPKeyring reads the keyring at the given path, falling back to the
+// configured one.
+func readPGPKeyring(path string) (openpgp.EntityList, error) {
+	if path == "" {
+		pgpLock.RLock()
+		path = pgpKeyring
+		pgpLock.RUnlock()
+	}
+	if path == "" {
+		path = os.Getenv(PGPKeyringEnv)
+	}
+	if path == "" {
+		return nil, fmt.Errorf("No OpenPGP keyring, set %s or configure the keyring", PGPKeyringEnv)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading OpenPGP keyring: %s", err)
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(contents))
+	if err != nil {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(contents))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing OpenPGP keyring %s: %s", path, err)
+	}
+	return keyring, nil
+}
+
+// pgpFingerprint formats the fingerprint of an entity's primary key the way
+// gpg does, as upper case hex.
+func pgpFingerprint(entity *openpgp.Entity) string {
+	return strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]))
+}
+
+// findPGPRecipient finds the entity with the given fingerprint or key ID,
+// e.g. the ID of its encryption subkey.
+func findPGPRecipient(keyring openpgp.EntityList, recipient string) (*openpgp.Entity, error) {
+	recipient = strings.ToUpper(strings.TrimPrefix(strings.Replace(recipient, " ", "", -1), "0x"))
+	for _, entity := range keyring {
+		if pgpFingerprint(entity) == recipient || entity.PrimaryKey.KeyIdString() == recipient {
+			return entity, nil
+		}
+		for _, subkey := range entity.Subkeys {
+			if subkey.PublicKey.KeyIdString() == recipient {
+				return entity, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("OpenPGP key '%s' not found in keyring", recipient)
+}
+
+// pgpRecipientKeys returns the entities of the keyring whose fingerprints are
+// listed in the comma separated recipients.
+func pgpRecipientKeys(keyring openpgp.EntityList, recipients string) (openpgp.EntityList, error) {
+	fingerprints := make(map[string]bool)
+	for _, fingerprint := range strings.Split(recipients, ",") {
+		fingerprints[strings.ToUpper(strings.TrimSpace(fingerprint))] = true
+	}
+	var keys openpgp.EntityList
+	for _, entity := range keyring {
+		if fingerprints[pgpFingerprint(entity)] {
+			keys = append(keys, entity)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("None of the OpenPGP keys the secret is encrypted to (%s) are in the keyring", recipients)
+	}
+	return keys, nil
+}
+
+func (c PGPCrypter) Name() string {
+	return "pgp"
+}
+
+func (c PGPCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	var recipientIDs []string
+	for _, recipient := range strings.Split(encryptParams["recipients"], ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			recipientIDs = append(recipientIDs, recipient)
+		}
+	}
+	if len(recipientIDs) == 0 {
+		return Ciphertext(""), nil, fmt.Errorf("Missing recipients parameter!")
+	}
+
+	keyring, err := readPGPKeyring(encryptParams["keyring"])
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+	var recipients []*openpgp.Entity
+	var fingerprints []string
+	for _, recipientID := range recipientIDs {
+		recipient, err := findPGPRecipient(keyring, recipientID)
+		if err != nil {
+			return Ciphertext(""), nil, err
+		}
+		recipients = append(recipients, recipient)
+		fingerprints = append(fingerprints, pgpFingerprint(recipient))
+	}
+
+	var ciphertext bytes.Buffer
+	config := &packet.Config{DefaultCipher: packet.CipherAES256}
+	writer, err := openpgp.Encrypt(&ciphertext, recipients, nil, &openpgp.FileHints{IsBinary: true}, config)
+	if err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+	if _, err := writer.Write([]byte(plaintext)); err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+
+	decryptParams := DecryptParams{"recipients": strings.Join(fingerprints, ",")}
+	return Ciphertext(base64.StdEncoding.EncodeToString(ciphertext.Bytes())), withVersion(pgpVersion, decryptParams), nil
+}
+
+func (c PGPCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(context.Background(), c.Name(), ciphertext, decryptParams)
+}
+
+func (c PGPCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c PGPCrypter) decryptV1(ctx context.Context, b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(string(b64ciphertext))
+	if err != nil {
+		return "", fmt.Errorf("Ciphertext is not valid base64 encoded in secret '%s'", b64ciphertext)
+	}
+	if decryptParams["recipients"] == "" {
+		return "", fmt.Errorf("Missing recipients parameter!")
+	}
+	keyring, err := readPGPKeyring("")
+	if err != nil {
+		return "", err
+	}
+	keyring, err = pgpRecipientKeys(keyring, decryptParams["recipients"])
+	if err != nil {
+		return "", err
+	}
+
+	pgpLock.RLock()
+	passphraseProvider := pgpPassphraseProvider
+	pgpLock.RUnlock()
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		// ReadMessage prompts until a key is decrypted, so only ask once
+		if prompted || symmetric {
+			return nil, fmt.Errorf("Invalid OpenPGP passphrase")
+		}
+		prompted = true
+		passphrase, err := passphraseProvider.Password()
+		if err != nil {
+			return nil, err
+		}
+		defer wipe(passphrase)
+		for _, key := range keys {
+			_ = key.PrivateKey.Decrypt(passphrase)
+		}
+		return nil, nil
+	}
+
+	// messages without integrity protection are refused by ReadMessage,
+	// and the integrity check fails the read of the body
+	message, err := openpgp.ReadMessage(bytes.NewReader(ciphertext), keyring, prompt, nil)
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting secret: %s", err)
+	}
+	if !message.IsEncrypted || message.IsSymmetricallyEncrypted {
+		return "", fmt.Errorf("Error decrypting secret: not encrypted to an OpenPGP key")
+	}
+	plaintext, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting secret: %s", err)
+	}
+	return string(plaintext), nil
+}
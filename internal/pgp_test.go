@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+// testdata/pgp-protected.asc holds a throwaway gpg generated key protected by
+// the passphrase "mypassphrase".
+const testPGPProtectedKeyring = "testdata/pgp-protected.asc"
+const testPGPProtectedFingerprint = "422FA9CA9792716BEFEE21F0841FDCD048CFB4BB"
+
+// newPGPEntity generates a throwaway key that, like gpg generated keys,
+// prefers SHA-256 and AES-256.
+func newPGPEntity(t *testing.T, name string) *openpgp.Entity {
+	config := &packet.Config{DefaultHash: crypto.SHA256, DefaultCipher: packet.CipherAES256}
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", config)
+	assert.NoError(t, err)
+	// the preferences are only signed when the entity is serialized privately
+	assert.NoError(t, entity.SerializePrivate(ioutil.Discard, nil))
+	return entity
+}
+
+func writePGPKeyring(t *testing.T, entities []*openpgp.Entity, private bool) string {
+	var keyring bytes.Buffer
+	for _, entity := range entities {
+		var err error
+		if private {
+			err = entity.SerializePrivate(&keyring, nil)
+		} else {
+			err = entity.Serialize(&keyring)
+		}
+		assert.NoError(t, err)
+	}
+	keyringFile, err := ioutil.TempFile("", "secretcrypt-pgp")
+	assert.NoError(t, err)
+	defer keyringFile.Close()
+	_, err = keyringFile.Write(keyring.Bytes())
+	assert.NoError(t, err)
+	return keyringFile.Name()
+}
+
+func TestPGP(t *testing.T) {
+	defer SetPGPKeyring("")
+	var entities []*openpgp.Entity
+	for _, name := range []string{"alice", "bob", "eve"} {
+		entities = append(entities, newPGPEntity(t, name))
+	}
+	publicKeyring := writePGPKeyring(t, entities, false)
+	defer os.Remove(publicKeyring)
+	alice, bob, eve := entities[0], entities[1], entities[2]
+
+	pgpCrypter := PGPCrypter{}
+	secret, decryptParams, err := pgpCrypter.Encrypt("mypass", EncryptParams{
+		"keyring":    publicKeyring,
+		"recipients": pgpFingerprint(alice) + "," + bob.Subkeys[0].PublicKey.KeyIdString(),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{
+		"recipients": pgpFingerprint(alice) + "," + pgpFingerprint(bob),
+		"v":          "1",
+	}, decryptParams)
+
+	for _, entity := range []*openpgp.Entity{alice, bob} {
+		privateKeyring := writePGPKeyring(t, []*openpgp.Entity{entity}, true)
+		defer os.Remove(privateKeyring)
+		SetPGPKeyring(privateKeyring)
+		plaintext, err := pgpCrypter.Decrypt(secret, decryptParams)
+		assert.NoError(t, err)
+		assert.Equal(t, "mypass", plaintext)
+	}
+
+	eveKeyring := writePGPKeyring(t, []*openpgp.Entity{eve}, true)
+	defer os.Remove(eveKeyring)
+	SetPGPKeyring(eveKeyring)
+	_, err = pgpCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "None of the OpenPGP keys the secret is encrypted to ("+
+		decryptParams["recipients"]+") are in the keyring")
+
+	// only the recorded recipients' keys are used
+	aliceEveKeyring := writePGPKeyring(t, []*openpgp.Entity{alice, eve}, true)
+	defer os.Remove(aliceEveKeyring)
+	SetPGPKeyring(aliceEveKeyring)
+	_, err = pgpCrypter.Decrypt(secret, DecryptParams{"recipients": pgpFingerprint(eve), "v": "1"})
+	assert.EqualError(t, err, "Error decrypting secret: openpgp: incorrect key")
+	_, err = pgpCrypter.Decrypt(secret, DecryptParams{"v": "1"})
+	assert.EqualError(t, err, "Missing recipients parameter!")
+
+	_, _, err = pgpCrypter.Encrypt("mypass", EncryptParams{
+		"keyring":    publicKeyring,
+		"recipients": "DEADBEEFDEADBEEF",
+	})
+	assert.EqualError(t, err, "OpenPGP key 'DEADBEEFDEADBEEF' not found in keyring")
+
+	_, _, err = pgpCrypter.Encrypt("mypass", EncryptParams{"keyring": publicKeyring})
+	assert.EqualError(t, err, "Missing recipients parameter!")
+}
+
+func TestPGPUnprotectedMessages(t *testing.T) {
+	defer SetPGPKeyring("")
+	alice := newPGPEntity(t, "alice")
+	privateKeyring := writePGPKeyring(t, []*openpgp.Entity{alice}, true)
+	defer os.Remove(privateKeyring)
+	SetPGPKeyring(privateKeyring)
+	decryptParams := DecryptParams{"recipients": pgpFingerprint(alice), "v": "1"}
+
+	pgpCrypter := PGPCrypter{}
+	// a symmetrically encrypted data packet without a modification detection code
+	unprotected := append([]byte{0xa4, 0x10}, make([]byte, 16)...)
+	_, err := pgpCrypter.Decrypt(Ciphertext(base64.StdEncoding.EncodeToString(unprotected)), decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret: openpgp: unsupported feature: message is not integrity protected")
+
+	// a literal data packet that is not encrypted at all
+	literal := []byte{0xcb, 0x0a, 'b', 0, 0, 0, 0, 0, 'm', 'y', 'p', 'w'}
+	_, err = pgpCrypter.Decrypt(Ciphertext(base64.StdEncoding.EncodeToString(literal)), decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret: not encrypted to an OpenPGP key")
+}
+
+func TestPGPPassphrase(t *testing.T) {
+	defer SetPGPKeyring("")
+	defer SetPGPPassphraseProvider(nil)
+	os.Setenv(PGPKeyringEnv, testPGPProtectedKeyring)
+	defer os.Unsetenv(PGPKeyringEnv)
+
+	pgpCrypter := PGPCrypter{}
+	secret, decryptParams, err := pgpCrypter.Encrypt("mypass", EncryptParams{
+		"recipients": testPGPProtectedFingerprint,
+	})
+	assert.NoError(t, err)
+
+	prompts := 0
+	SetPGPPassphraseProvider(PasswordProviderFunc(func() ([]byte, error) {
+		prompts++
+		return []byte("mypassphrase"), nil
+	}))
+	plaintext, err := pgpCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, 1, prompts)
+
+	SetPGPPassphraseProvider(PasswordProviderFunc(func() ([]byte, error) {
+		return []byte("wrong"), nil
+	}))
+	_, err = pgpCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret: Invalid OpenPGP passphrase")
+
+	SetPGPPassphraseProvider(PasswordProviderFunc(func() ([]byte, error) {
+		return nil, fmt.Errorf("no passphrase")
+	}))
+	_, err = pgpCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret: no passphrase")
+}
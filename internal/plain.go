@@ -1,15 +1,29 @@
 package internal
 
+import "context"
+
 type PlainCrypter struct{}
 
+const plainVersion = "1"
+
 func (pc PlainCrypter) Name() string {
 	return "plain"
 }
 
 func (pc PlainCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
-	return Ciphertext(plaintext), nil, nil
+	return Ciphertext(plaintext), withVersion(plainVersion, nil), nil
 }
 
 func (pc PlainCrypter) Decrypt(myCiphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return pc.decrypters().decrypt(context.Background(), pc.Name(), myCiphertext, decryptParams)
+}
+
+func (pc PlainCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": pc.decryptV1,
+	}
+}
+
+func (pc PlainCrypter) decryptV1(ctx context.Context, myCiphertext Ciphertext, decryptParams DecryptParams) (string, error) {
 	return string(myCiphertext), nil
 }
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ShamirCrypter encrypts secrets with a random data key that is split into
+// shares with Shamir's secret sharing, each share wrapped by a different
+// crypter, e.g. a kms key, an age recipient and a password. The secret only
+// decrypts when at least threshold of the shares can be unwrapped.
+//
+// The crypters and their encrypt parameters are given like for the multi
+// crypter, and the threshold in the "threshold" encrypt parameter. Indexed
+// entries, e.g. "age.1,age.2,age.3", give several keys of the same crypter a
+// share each.
+type ShamirCrypter struct{}
+
+const shamirVersion = "1"
+
+const shamirThresholdParam = "threshold"
+
+func (c ShamirCrypter) Name() string {
+	return "shamir"
+}
+
+func (c ShamirCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	crypterNames, err := nestedCrypterNames(c.Name(), encryptParams[multiCryptersParam])
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+	if encryptParams[shamirThresholdParam] == "" {
+		return Ciphertext(""), nil, fmt.Errorf("Missing %s parameter!", shamirThresholdParam)
+	}
+	threshold, err := strconv.Atoi(encryptParams[shamirThresholdParam])
+	if err != nil || threshold < 1 || threshold > len(crypterNames) {
+		return Ciphertext(""), nil, fmt.Errorf("Invalid threshold '%s', expected 1 to %d", encryptParams[shamirThresholdParam], len(crypterNames))
+	}
+	// with a threshold of 1, each share is the data key itself
+	if threshold == 1 {
+		for _, name := range crypterNames {
+			if isPlainCrypter(name) {
+				return Ciphertext(""), nil, fmt.Errorf("Crypter '%s' cannot be used in shamir with threshold 1, it would leave the data key unencrypted", name)
+			}
+		}
+	}
+
+	dataKey := make([]byte, multiDataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error generating data key: %s", err)
+	}
+	defer wipe(dataKey)
+	shares, err := shamirSplit(dataKey, len(crypterNames), threshold)
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+
+	decryptParams := DecryptParams{
+		multiCryptersParam:   strings.Join(crypterNames, ","),
+		shamirThresholdParam: strconv.Itoa(threshold),
+	}
+	for i, name := range crypterNames {
+		wrappedShare, err := wrapKey(name, shares[i], nestedEncryptParams(name, encryptParams))
+		wipe(shares[i])
+		if err != nil {
+			return Ciphertext(""), nil, fmt.Errorf("Error wrapping key share: %s", err)
+		}
+		decryptParams[name] = wrappedShare
+	}
+
+	ciphertext, err := AESEncrypt(dataKey, plaintext)
+	if err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+	return Ciphertext(ciphertext), withVersion(shamirVersion, decryptParams), nil
+}
+
+func (c ShamirCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.DecryptContext(context.Background(), ciphertext, decryptParams)
+}
+
+func (c ShamirCrypter) DecryptContext(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(ctx, c.Name(), ciphertext, decryptParams)
+}
+
+func (c ShamirCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c ShamirCrypter) decryptV1(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	for _, param := range []string{multiCryptersParam, shamirThresholdParam} {
+		if decryptParams[param] == "" {
+			return "", fmt.Errorf("Missing %s parameter!", param)
+		}
+	}
+	threshold, err := strconv.Atoi(decryptParams[shamirThresholdParam])
+	if err != nil || threshold < 1 {
+		return "", fmt.Errorf("Invalid threshold '%s'", decryptParams[shamirThresholdParam])
+	}
+
+	// unwrap only as many shares as needed, so that e.g. no password is
+	// prompted for when the kms shares suffice. A share that fails to combine
+	// with the others, e.g. one swapped in from another secret, is worked
+	// around by unwrapping more shares and trying the new combinations.
+	var shares [][]byte
+	defer func() {
+		for _, share := range shares {
+			wipe(share)
+		}
+	}()
+	var failures []string
+	var combineErr error
+	for _, name := range strings.Split(decryptParams[multiCryptersParam], ",") {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		share, err := unwrapKey(ctx, name, decryptParams[name])
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		shares = append(shares, share)
+		if len(shares) < threshold {
+			continue
+		}
+		// the combinations without the new share have been tried already
+		for _, subset := range shareSubsets(len(shares)-1, threshold-1) {
+			plaintext, err := shamirDecrypt(append(pickShares(shares, subset), share), ciphertext)
+			if err == nil {
+				return plaintext, nil
+			}
+			combineErr = err
+		}
+	}
+	if len(shares) < threshold {
+		return "", fmt.Errorf("Error decrypting secret, only %d of the %d required key shares could be unwrapped: %s", len(shares), threshold, strings.Join(failures, "; "))
+	}
+	return "", fmt.Errorf("Error decrypting secret: %s", combineErr)
+}
+
+// shamirDecrypt decrypts the ciphertext with the data key combined from the
+// shares.
+func shamirDecrypt(shares [][]byte, ciphertext Ciphertext) (string, error) {
+	dataKey, err := shamirCombine(shares)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(dataKey)
+	return AESDecrypt(dataKey, string(ciphertext))
+}
+
+// shareSubsets returns the indexes of all k element subsets of n shares.
+func shareSubsets(n, k int) [][]int {
+	if k == 0 {
+		return [][]int{nil}
+	}
+	var subsets [][]int
+	for last := k - 1; last < n; last++ {
+		for _, subset := range shareSubsets(last, k-1) {
+			subsets = append(subsets, append(subset, last))
+		}
+	}
+	return subsets
+}
+
+func pickShares(shares [][]byte, indexes []int) [][]byte {
+	picked := make([][]byte, 0, len(indexes)+1)
+	for _, i := range indexes {
+		picked = append(picked, shares[i])
+	}
+	return picked
+}
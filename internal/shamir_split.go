@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Shamir's secret sharing over GF(2^8) with the AES polynomial
+// x^8 + x^4 + x^3 + x + 1. Each byte of the secret is the constant term of
+// its own random polynomial of degree threshold-1, and a share holds its x
+// coordinate followed by the polynomials evaluated at x.
+
+var gfExp [510]byte
+var gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+		// multiply by the generator 3
+		xtime := x << 1
+		if x&0x80 != 0 {
+			xtime ^= 0x1b
+		}
+		x ^= xtime
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// shamirSplit splits the secret into n shares, any threshold of which
+// recover it.
+func shamirSplit(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 1 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("Invalid threshold %d of %d shares", threshold, n)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Cannot split an empty secret")
+	}
+
+	coefficients := make([]byte, len(secret)*(threshold-1))
+	if _, err := rand.Read(coefficients); err != nil {
+		return nil, fmt.Errorf("Error generating share coefficients: %s", err)
+	}
+	defer wipe(coefficients)
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		share := make([]byte, len(secret)+1)
+		share[0] = x
+		for b, secretByte := range secret {
+			// Horner's method, from the highest degree coefficient down
+			var y byte
+			for d := threshold - 2; d >= 0; d-- {
+				y = gfMul(y, x) ^ coefficients[b*(threshold-1)+d]
+			}
+			share[b+1] = gfMul(y, x) ^ secretByte
+		}
+		shares[i] = share
+	}
+	return shares, nil
+}
+
+// shamirCombine recovers the secret from at least threshold distinct shares
+// by Lagrange interpolation at x = 0.
+func shamirCombine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("No shares to combine")
+	}
+	length := len(shares[0])
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) < 2 || len(share) != length {
+			return nil, fmt.Errorf("Malformed share")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("Duplicate or invalid share")
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, length-1)
+	for i, share := range shares {
+		// the Lagrange basis polynomial of share i evaluated at 0; subtraction
+		// is xor in GF(2^8)
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(other[0], other[0]^share[0]))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share[b+1], basis)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShamirSplitCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := shamirSplit(secret, 5, 3)
+	assert.NoError(t, err)
+	assert.Len(t, shares, 5)
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var subsetShares [][]byte
+		for _, i := range subset {
+			subsetShares = append(subsetShares, shares[i])
+		}
+		combined, err := shamirCombine(subsetShares)
+		assert.NoError(t, err)
+		assert.Equal(t, secret, combined, "%v", subset)
+	}
+
+	combined, err := shamirCombine(shares[:2])
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret, combined)
+
+	_, err = shamirCombine([][]byte{shares[0], shares[0], shares[1]})
+	assert.EqualError(t, err, "Duplicate or invalid share")
+	_, err = shamirSplit(secret, 2, 3)
+	assert.EqualError(t, err, "Invalid threshold 3 of 2 shares")
+}
+
+func TestGF256(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			assert.Equal(t, byte(a), gfDiv(gfMul(byte(a), byte(b)), byte(b)))
+		}
+	}
+	// the FIPS-197 example
+	assert.Equal(t, byte(0xc1), gfMul(0x57, 0x83))
+}
+
+func TestShamir(t *testing.T) {
+	f := newWrapperFixture(t)
+	defer f.close()
+
+	shamirCrypter := ShamirCrypter{}
+	secret, decryptParams, err := shamirCrypter.Encrypt("myplaintext", EncryptParams{
+		"crypters":         "plain,age,password",
+		"threshold":        "2",
+		"age.recipients":   f.identity.Recipient().String(),
+		"password.scryptN": "1024",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "plain,age,password", decryptParams["crypters"])
+	assert.Equal(t, "2", decryptParams["threshold"])
+	assert.Equal(t, "1", decryptParams["v"])
+	f.prompts = 0
+
+	// the password is not asked for when the first two shares suffice
+	SetAgeIdentityFile(f.identityFile)
+	plaintext, err := shamirCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+	assert.Equal(t, 0, f.prompts)
+
+	SetAgeIdentityFile("")
+	plaintext, err = shamirCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+	assert.Equal(t, 1, f.prompts)
+
+	f.password = "notmypass"
+	_, err = shamirCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret, only 1 of the 2 required key shares could be unwrapped: "+
+		"age: No age identity file, set SECRETCRYPT_AGE_IDENTITY_FILE or configure the identity file; "+
+		"password: Error decrypting secret: Ciphertext failed authentication")
+
+	// a share of another secret recovers the wrong data key
+	_, otherParams, err := shamirCrypter.Encrypt("myplaintext", EncryptParams{
+		"crypters":       "plain,age",
+		"threshold":      "2",
+		"age.recipients": f.identity.Recipient().String(),
+	})
+	assert.NoError(t, err)
+	SetAgeIdentityFile(f.identityFile)
+	decryptParams["age"] = otherParams["age"]
+	_, err = shamirCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret: Ciphertext failed authentication")
+
+	// ... and is worked around with the remaining shares
+	f.password = "mypass"
+	f.prompts = 0
+	plaintext, err = shamirCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+	assert.Equal(t, 1, f.prompts)
+}
+
+func TestShamirSameCrypter(t *testing.T) {
+	defer SetAgeIdentityFile("")
+	var identities []*age.X25519Identity
+	encryptParams := EncryptParams{"crypters": "age.1,age.2,age.3", "threshold": "2"}
+	for i := 1; i <= 3; i++ {
+		identity, err := age.GenerateX25519Identity()
+		assert.NoError(t, err)
+		identities = append(identities, identity)
+		encryptParams[fmt.Sprintf("age.%d.recipients", i)] = identity.Recipient().String()
+	}
+
+	// 2 of 3 age recipients, e.g. three people, must come together
+	shamirCrypter := ShamirCrypter{}
+	secret, decryptParams, err := shamirCrypter.Encrypt("myplaintext", encryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "age.1,age.2,age.3", decryptParams["crypters"])
+
+	for _, holders := range [][]int{{0, 1}, {0, 2}, {1, 2}} {
+		identityFile := writeAgeIdentityFile(t, identities[holders[0]], identities[holders[1]])
+		defer os.Remove(identityFile)
+		SetAgeIdentityFile(identityFile)
+		plaintext, err := shamirCrypter.Decrypt(secret, decryptParams)
+		assert.NoError(t, err, "%v", holders)
+		assert.Equal(t, "myplaintext", plaintext, "%v", holders)
+	}
+
+	identityFile := writeAgeIdentityFile(t, identities[1])
+	defer os.Remove(identityFile)
+	SetAgeIdentityFile(identityFile)
+	_, err = shamirCrypter.Decrypt(secret, decryptParams)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Error decrypting secret, only 1 of the 2 required key shares could be unwrapped: age.1: ")
+}
+
+func TestShareSubsets(t *testing.T) {
+	assert.Equal(t, [][]int{nil}, shareSubsets(3, 0))
+	assert.Equal(t, [][]int{{0}, {1}, {2}}, shareSubsets(3, 1))
+	assert.Equal(t, [][]int{{0, 1}, {0, 2}, {1, 2}, {0, 3}, {1, 3}, {2, 3}}, shareSubsets(4, 2))
+	assert.Empty(t, shareSubsets(1, 2))
+}
+
+func TestShamirEncryptErrors(t *testing.T) {
+	shamirCrypter := ShamirCrypter{}
+	for _, tc := range []struct {
+		crypters  string
+		threshold string
+		err       string
+	}{
+		{"", "1", "Missing crypters parameter!"},
+		{"plain,local", "", "Missing threshold parameter!"},
+		{"plain,local", "3", "Invalid threshold '3', expected 1 to 2"},
+		{"plain,local", "0", "Invalid threshold '0', expected 1 to 2"},
+		{"plain,local", "two", "Invalid threshold 'two', expected 1 to 2"},
+		{"plain,local", "1", "Crypter 'plain' cannot be used in shamir with threshold 1, it would leave the data key unencrypted"},
+		{"plain,multi", "2", "Crypter 'multi' cannot be nested in shamir"},
+		{"plain,shamir", "2", "Crypter 'shamir' cannot be nested in shamir"},
+		{"plain,age", "2", "Error wrapping key share: age: Missing recipients parameter!"},
+	} {
+		_, _, err := shamirCrypter.Encrypt("myplaintext", EncryptParams{"crypters": tc.crypters, "threshold": tc.threshold})
+		assert.EqualError(t, err, tc.err, tc.crypters)
+	}
+}
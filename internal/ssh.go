@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHCrypter encrypts secrets to one or more SSH public keys, so that each
+// holder of a matching private key can decrypt them offline. Secrets are age
+// files with ssh-ed25519 or ssh-rsa recipient stanzas, or, for keys held by an
+// ssh-agent, have their data key wrapped with keys derived from the agent's
+// signatures.
+type SSHCrypter struct{}
+
+const sshVersion = "1"
+
+// SSHIdentityFileEnv names the environment variable holding the path of the
+// SSH private key used for decryption.
+const SSHIdentityFileEnv = "SECRETCRYPT_SSH_IDENTITY_FILE"
+
+// sshDefaultIdentities are tried in ~/.ssh when no identity file is set.
+var sshDefaultIdentities = []string{"id_ed25519", "id_rsa"}
+
+var sshIdentityFile string
+var sshPassphraseProvider PasswordProvider = TerminalPasswordProvider{}
+var sshLock sync.RWMutex
+
+// SetSSHIdentityFile sets the path of the SSH private key used for
+// decryption. It takes precedence over the SECRETCRYPT_SSH_IDENTITY_FILE
+// environment variable and the default ~/.ssh/id_ed25519 and ~/.ssh/id_rsa
+// keys. Passing "" removes the override.
+func SetSSHIdentityFile(path string) {
+	sshLock.Lock()
+	defer sshLock.Unlock()
+	sshIdentityFile = path
+}
+
+// SetSSHPassphraseProvider sets the provider of the passphrase protecting the
+// SSH private keys. Passing nil restores the default interactive terminal
+// prompt.
+func SetSSHPassphraseProvider(provider PasswordProvider) {
+	if provider == nil {
+		provider = TerminalPasswordProvider{}
+	}
+	sshLock.Lock()
+	defer sshLock.Unlock()
+	sshPassphraseProvider = provider
+}
+
+// sshIdentityPaths returns the configured identity file, or the default keys
+// that exist in ~/.ssh.
+func sshIdentityPaths() ([]string, error) {
+	sshLock.RLock()
+	path := sshIdentityFile
+	sshLock.RUnlock()
+	if path == "" {
+		path = os.Getenv(SSHIdentityFileEnv)
+	}
+	if path != "" {
+		return []string{path}, nil
+	}
+
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, name := range sshDefaultIdentities {
+		path := filepath.Join(currentUser.HomeDir, ".ssh", name)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No SSH identity found, set %s or configure the identity file", SSHIdentityFileEnv)
+	}
+	return paths, nil
+}
+
+// sshIdentity reads the private key at path. Passphrase protected keys are
+// only decrypted when a secret is encrypted to them, so their public key is
+// taken from the key file itself or from the .pub file next to it.
+func sshIdentity(path string, passphrase func() ([]byte, error)) (age.Identity, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading SSH identity file: %s", err)
+	}
+	identity, err := agessh.ParseIdentity(pemBytes)
+	if err == nil {
+		return identity, nil
+	}
+	missingPassphrase, ok := err.(*ssh.PassphraseMissingError)
+	if !ok {
+		return nil, fmt.Errorf("Error parsing SSH identity file %s: %s", path, err)
+	}
+
+	publicKey := missingPassphrase.PublicKey
+	if publicKey == nil {
+		authorizedKey, err := ioutil.ReadFile(path + ".pub")
+		if err != nil {
+			return nil, fmt.Errorf("Error reading public key of encrypted SSH identity file %s: %s", path, err)
+		}
+		publicKey, _, _, _, err = ssh.ParseAuthorizedKey(authorizedKey)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing public key of encrypted SSH identity file %s: %s", path, err)
+		}
+	}
+	identity, err = agessh.NewEncryptedSSHIdentity(publicKey, pemBytes, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing SSH identity file %s: %s", path, err)
+	}
+	return identity, nil
+}
+
+func sshIdentities() ([]age.Identity, error) {
+	paths, err := sshIdentityPaths()
+	if err != nil {
+		return nil, err
+	}
+	sshLock.RLock()
+	passphraseProvider := sshPassphraseProvider
+	sshLock.RUnlock()
+
+	var identities []age.Identity
+	for _, path := range paths {
+		identity, err := sshIdentity(path, passphraseProvider.Password)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, nil
+}
+
+// parseSSHPublicKey parses an authorized_keys line.
+func parseSSHPublicKey(line string) (ssh.PublicKey, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SSH public key '%s': %s", line, err)
+	}
+	return publicKey, nil
+}
+
+// sshRecipient converts an SSH public key into an age recipient.
+func sshRecipient(publicKey ssh.PublicKey) (age.Recipient, error) {
+	var recipient age.Recipient
+	var err error
+	switch publicKey.Type() {
+	case ssh.KeyAlgoED25519:
+		recipient, err = agessh.NewEd25519Recipient(publicKey)
+	case ssh.KeyAlgoRSA:
+		recipient, err = agessh.NewRSARecipient(publicKey)
+	default:
+		return nil, fmt.Errorf("Unsupported SSH key type %s, use an ssh-ed25519 or ssh-rsa key", publicKey.Type())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SSH public key %s: %s", ssh.FingerprintSHA256(publicKey), err)
+	}
+	return recipient, nil
+}
+
+func (c SSHCrypter) Name() string {
+	return "ssh"
+}
+
+// Encrypt encrypts the plaintext to the keys given as authorized_keys lines
+// in the "recipients" encrypt parameter. With the "agent" encrypt parameter
+// set to "true", the secret is instead encrypted for decryption through an
+// ssh-agent holding one of the keys. The keys must be in your own agent
+// already, so other people's public keys cannot be encrypted to this way.
+func (c SSHCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	var publicKeys []ssh.PublicKey
+	for _, line := range strings.Split(encryptParams["recipients"], "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		publicKey, err := parseSSHPublicKey(line)
+		if err != nil {
+			return Ciphertext(""), nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	if len(publicKeys) == 0 {
+		return Ciphertext(""), nil, fmt.Errorf("Missing recipients parameter!")
+	}
+	if encryptParams["agent"] == "true" {
+		return c.encryptAgent(plaintext, publicKeys)
+	}
+
+	var recipients []age.Recipient
+	var fingerprints []string
+	for _, publicKey := range publicKeys {
+		recipient, err := sshRecipient(publicKey)
+		if err != nil {
+			return Ciphertext(""), nil, err
+		}
+		recipients = append(recipients, recipient)
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(publicKey))
+	}
+
+	ciphertext, err := ageEncrypt(plaintext, recipients)
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+	decryptParams := DecryptParams{"recipients": strings.Join(fingerprints, ",")}
+	return ciphertext, withVersion(sshVersion, decryptParams), nil
+}
+
+func (c SSHCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(context.Background(), c.Name(), ciphertext, decryptParams)
+}
+
+func (c SSHCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c SSHCrypter) decryptV1(ctx context.Context, b64ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	if decryptParams[sshAgentParam] == "1" {
+		return c.decryptAgent(ctx, b64ciphertext, decryptParams)
+	}
+	identities, err := sshIdentities()
+	if err != nil {
+		return "", err
+	}
+	return ageDecrypt(b64ciphertext, identities)
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentParam is the decrypt param marking secrets whose data key is wrapped
+// with keys derived from ssh-agent signatures, instead of being encrypted with
+// age to the SSH keys.
+const sshAgentParam = "agent"
+
+// SSHAgentSocketEnv names the environment variable holding the ssh-agent
+// socket.
+const SSHAgentSocketEnv = "SSH_AUTH_SOCK"
+
+// sshAgentSignaturePrefix is prepended to the per-secret nonce before it is
+// signed, so that the signatures cannot be mistaken for SSH authentication
+// signatures and vice versa.
+const sshAgentSignaturePrefix = "secretcrypt ssh-agent key wrap\x00"
+
+const sshAgentNonceSize = 32
+
+var sshAgentSocket string
+
+// SetSSHAgentSocket sets the path of the ssh-agent socket. It takes
+// precedence over the SSH_AUTH_SOCK environment variable. Passing ""
+// removes the override.
+func SetSSHAgentSocket(path string) {
+	sshLock.Lock()
+	defer sshLock.Unlock()
+	sshAgentSocket = path
+}
+
+// dialSSHAgent connects to the configured ssh-agent. The caller closes the
+// connection.
+func dialSSHAgent(ctx context.Context) (agent.ExtendedAgent, net.Conn, error) {
+	sshLock.RLock()
+	path := sshAgentSocket
+	sshLock.RUnlock()
+	if path == "" {
+		path = os.Getenv(SSHAgentSocketEnv)
+	}
+	if path == "" {
+		return nil, nil, fmt.Errorf("No ssh-agent, set %s or configure the agent socket", SSHAgentSocketEnv)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error connecting to ssh-agent: %s", err)
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// sshAgentSignature has the agent sign the nonce with the key. Only
+// ssh-ed25519 and PKCS #1 v1.5 RSA signatures are deterministic, so that the
+// same key can be derived from them again when decrypting.
+func sshAgentSignature(sshAgent agent.ExtendedAgent, publicKey ssh.PublicKey, nonce []byte) ([]byte, error) {
+	var flags agent.SignatureFlags
+	switch publicKey.Type() {
+	case ssh.KeyAlgoED25519:
+	case ssh.KeyAlgoRSA:
+		flags = agent.SignatureFlagRsaSha256
+	default:
+		return nil, fmt.Errorf("Unsupported SSH key type %s, use an ssh-ed25519 or ssh-rsa key", publicKey.Type())
+	}
+	signature, err := sshAgent.SignWithFlags(publicKey, append([]byte(sshAgentSignaturePrefix), nonce...), flags)
+	if err != nil {
+		return nil, fmt.Errorf("Error signing with SSH key %s: %s", ssh.FingerprintSHA256(publicKey), err)
+	}
+	return signature.Blob, nil
+}
+
+// encryptAgent encrypts the plaintext with a random data key, wrapped for each
+// recipient with a key derived from the agent's signature of a random nonce.
+// The recipients' private keys must therefore be in the agent, so that one can
+// only encrypt to one's own keys, not to other people's public keys.
+func (c SSHCrypter) encryptAgent(plaintext string, publicKeys []ssh.PublicKey) (Ciphertext, DecryptParams, error) {
+	sshAgent, conn, err := dialSSHAgent(context.Background())
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+	defer conn.Close()
+
+	nonce := make([]byte, sshAgentNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error generating nonce: %s", err)
+	}
+	dataKey := make([]byte, multiDataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error generating data key: %s", err)
+	}
+	defer wipe(dataKey)
+
+	var fingerprints, wrappedKeys []string
+	for _, publicKey := range publicKeys {
+		signature, err := sshAgentSignature(sshAgent, publicKey, nonce)
+		if err != nil {
+			return Ciphertext(""), nil, err
+		}
+		again, err := sshAgentSignature(sshAgent, publicKey, nonce)
+		if err != nil {
+			return Ciphertext(""), nil, err
+		}
+		if !bytes.Equal(signature, again) {
+			return Ciphertext(""), nil, fmt.Errorf("SSH key %s does not sign deterministically", ssh.FingerprintSHA256(publicKey))
+		}
+		// AESEncrypt derives the wrapping key from the signature with HKDF
+		wrappedKey, err := AESEncrypt(signature, base64.StdEncoding.EncodeToString(dataKey))
+		wipe(signature)
+		wipe(again)
+		if err != nil {
+			return Ciphertext(""), nil, fmt.Errorf("Error wrapping data key: %s", err)
+		}
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(publicKey))
+		wrappedKeys = append(wrappedKeys, wrappedKey)
+	}
+
+	ciphertext, err := AESEncrypt(dataKey, plaintext)
+	if err != nil {
+		return Ciphertext(""), nil, fmt.Errorf("Error encrypting plaintext: %s", err)
+	}
+	decryptParams := DecryptParams{
+		"recipients":  strings.Join(fingerprints, ","),
+		"nonce":       base64.StdEncoding.EncodeToString(nonce),
+		"keys":        strings.Join(wrappedKeys, ","),
+		sshAgentParam: "1",
+	}
+	return Ciphertext(ciphertext), withVersion(sshVersion, decryptParams), nil
+}
+
+// decryptAgent decrypts secrets encrypted by encryptAgent with the first key
+// in the agent that the secret is encrypted to.
+func (c SSHCrypter) decryptAgent(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	for _, param := range []string{"recipients", "nonce", "keys"} {
+		if decryptParams[param] == "" {
+			return "", fmt.Errorf("Missing %s parameter!", param)
+		}
+	}
+	fingerprints := strings.Split(decryptParams["recipients"], ",")
+	wrappedKeys := strings.Split(decryptParams["keys"], ",")
+	if len(fingerprints) != len(wrappedKeys) {
+		return "", fmt.Errorf("Expected %d wrapped keys, got %d", len(fingerprints), len(wrappedKeys))
+	}
+	nonce, err := base64.StdEncoding.DecodeString(decryptParams["nonce"])
+	if err != nil {
+		return "", fmt.Errorf("Nonce is not valid base64")
+	}
+
+	sshAgent, conn, err := dialSSHAgent(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	agentKeys, err := sshAgent.List()
+	if err != nil {
+		return "", fmt.Errorf("Error listing ssh-agent keys: %s", err)
+	}
+
+	var failures []string
+	for _, agentKey := range agentKeys {
+		fingerprint := ssh.FingerprintSHA256(agentKey)
+		for i := range fingerprints {
+			if fingerprints[i] != fingerprint {
+				continue
+			}
+			signature, err := sshAgentSignature(sshAgent, agentKey, nonce)
+			if err != nil {
+				failures = append(failures, err.Error())
+				continue
+			}
+			encodedKey, err := AESDecrypt(signature, wrappedKeys[i])
+			wipe(signature)
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", fingerprint, err))
+				continue
+			}
+			dataKey, err := base64.StdEncoding.DecodeString(encodedKey)
+			if err != nil {
+				return "", fmt.Errorf("Wrapped key is not valid base64")
+			}
+			plaintext, err := AESDecrypt(dataKey, string(ciphertext))
+			wipe(dataKey)
+			if err != nil {
+				return "", fmt.Errorf("Error decrypting secret: %s", err)
+			}
+			return plaintext, nil
+		}
+	}
+	if len(failures) > 0 {
+		return "", fmt.Errorf("Error decrypting secret: %s", strings.Join(failures, "; "))
+	}
+	return "", fmt.Errorf("None of the SSH keys the secret is encrypted to (%s) are in the ssh-agent", decryptParams["recipients"])
+}
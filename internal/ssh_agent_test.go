@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveSSHAgent serves an in-process ssh-agent holding the given private keys
+// on a unix socket and returns the socket path and a function stopping it.
+func serveSSHAgent(t *testing.T, privateKeys ...interface{}) (string, func()) {
+	keyring := agent.NewKeyring()
+	for _, privateKey := range privateKeys {
+		assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: privateKey}))
+	}
+	dir, err := ioutil.TempDir("", "secretcrypt-agent")
+	assert.NoError(t, err)
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	return socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func readSSHPrivateKey(t *testing.T, path string) interface{} {
+	pemBytes, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	privateKey, err := ssh.ParseRawPrivateKey(pemBytes)
+	assert.NoError(t, err)
+	return privateKey
+}
+
+func TestSSHAgent(t *testing.T) {
+	defer SetSSHAgentSocket("")
+	aliceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	alicePublicKey, err := ssh.NewPublicKey(&aliceKey.PublicKey)
+	assert.NoError(t, err)
+	aliceAuthorizedKey := string(ssh.MarshalAuthorizedKey(alicePublicKey))
+	bobAuthorizedKey := readSSHAuthorizedKey(t, testSSHEd25519Key)
+	bobKey := readSSHPrivateKey(t, testSSHEd25519Key)
+
+	socket, stop := serveSSHAgent(t, aliceKey, bobKey)
+	defer stop()
+	SetSSHAgentSocket(socket)
+
+	sshCrypter := SSHCrypter{}
+	secret, decryptParams, err := sshCrypter.Encrypt("mypass", EncryptParams{
+		"recipients": aliceAuthorizedKey + "\n" + bobAuthorizedKey,
+		"agent":      "true",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, sshFingerprint(t, aliceAuthorizedKey)+","+sshFingerprint(t, bobAuthorizedKey), decryptParams["recipients"])
+	assert.Equal(t, "1", decryptParams["v"])
+	assert.Equal(t, "1", decryptParams["agent"])
+
+	plaintext, err := sshCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	// each key in the agent can decrypt on its own
+	for _, privateKey := range []interface{}{aliceKey, bobKey} {
+		socket, stop := serveSSHAgent(t, privateKey)
+		SetSSHAgentSocket(socket)
+		plaintext, err := sshCrypter.Decrypt(secret, decryptParams)
+		assert.NoError(t, err)
+		assert.Equal(t, "mypass", plaintext)
+		stop()
+	}
+
+	eveKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	eveSocket, stopEve := serveSSHAgent(t, eveKey)
+	defer stopEve()
+	SetSSHAgentSocket(eveSocket)
+	_, err = sshCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "None of the SSH keys the secret is encrypted to ("+decryptParams["recipients"]+") are in the ssh-agent")
+
+	// a key that is not in the agent cannot be encrypted to
+	_, _, err = sshCrypter.Encrypt("mypass", EncryptParams{"recipients": aliceAuthorizedKey, "agent": "true"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Error signing with SSH key "+sshFingerprint(t, aliceAuthorizedKey))
+
+	// signatures of another nonce fail to unwrap the data key
+	SetSSHAgentSocket(socket)
+	tampered := DecryptParams{}
+	for key, value := range decryptParams {
+		tampered[key] = value
+	}
+	tampered["nonce"] = "AAAA"
+	_, err = sshCrypter.Decrypt(secret, tampered)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Ciphertext failed authentication")
+}
+
+func TestSSHAgentErrors(t *testing.T) {
+	defer SetSSHAgentSocket("")
+	if socket, ok := os.LookupEnv(SSHAgentSocketEnv); ok {
+		defer os.Setenv(SSHAgentSocketEnv, socket)
+	}
+	os.Unsetenv(SSHAgentSocketEnv)
+	bobAuthorizedKey := readSSHAuthorizedKey(t, testSSHEd25519Key)
+
+	sshCrypter := SSHCrypter{}
+	_, _, err := sshCrypter.Encrypt("mypass", EncryptParams{"recipients": bobAuthorizedKey, "agent": "true"})
+	assert.EqualError(t, err, "No ssh-agent, set SSH_AUTH_SOCK or configure the agent socket")
+	_, err = sshCrypter.Decrypt("gcm1.AAAA", DecryptParams{"recipients": "SHA256:x", "nonce": "AAAA", "keys": "gcm1.AAAA", "agent": "1", "v": "1"})
+	assert.EqualError(t, err, "No ssh-agent, set SSH_AUTH_SOCK or configure the agent socket")
+	_, err = sshCrypter.Decrypt("gcm1.AAAA", DecryptParams{"recipients": "SHA256:x", "nonce": "AAAA", "agent": "1", "v": "1"})
+	assert.EqualError(t, err, "Missing keys parameter!")
+	_, err = sshCrypter.Decrypt("gcm1.AAAA", DecryptParams{"recipients": "SHA256:x,SHA256:y", "nonce": "AAAA", "keys": "gcm1.AAAA", "agent": "1", "v": "1"})
+	assert.EqualError(t, err, "Expected 2 wrapped keys, got 1")
+
+	ecdsaKey := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg="
+	socket, stop := serveSSHAgent(t)
+	defer stop()
+	SetSSHAgentSocket(socket)
+	_, _, err = sshCrypter.Encrypt("mypass", EncryptParams{"recipients": ecdsaKey, "agent": "true"})
+	assert.EqualError(t, err, "Unsupported SSH key type ecdsa-sha2-nistp256, use an ssh-ed25519 or ssh-rsa key")
+}
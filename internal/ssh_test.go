@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testdata/ssh-* hold throwaway ssh-keygen generated keys, the protected ones
+// with the passphrase "mypassphrase". ssh-protected-rsa is in the legacy PEM
+// format, which does not include the public key.
+const testSSHEd25519Key = "testdata/ssh-ed25519"
+const testSSHProtectedEd25519Key = "testdata/ssh-protected-ed25519"
+const testSSHProtectedRSAKey = "testdata/ssh-protected-rsa"
+
+func readSSHAuthorizedKey(t *testing.T, path string) string {
+	authorizedKey, err := ioutil.ReadFile(path + ".pub")
+	assert.NoError(t, err)
+	return string(authorizedKey)
+}
+
+func sshFingerprint(t *testing.T, authorizedKey string) string {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	assert.NoError(t, err)
+	return ssh.FingerprintSHA256(publicKey)
+}
+
+// newSSHRSAKey writes a throwaway RSA private key and returns its path and
+// authorized_keys line.
+func newSSHRSAKey(t *testing.T) (string, string) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keyFile, err := ioutil.TempFile("", "secretcrypt-ssh")
+	assert.NoError(t, err)
+	defer keyFile.Close()
+	err = pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	assert.NoError(t, err)
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	assert.NoError(t, err)
+	return keyFile.Name(), string(ssh.MarshalAuthorizedKey(publicKey))
+}
+
+func TestSSH(t *testing.T) {
+	defer SetSSHIdentityFile("")
+	aliceKey, aliceAuthorizedKey := newSSHRSAKey(t)
+	defer os.Remove(aliceKey)
+	eveKey, _ := newSSHRSAKey(t)
+	defer os.Remove(eveKey)
+	bobAuthorizedKey := readSSHAuthorizedKey(t, testSSHEd25519Key)
+
+	sshCrypter := SSHCrypter{}
+	secret, decryptParams, err := sshCrypter.Encrypt("mypass", EncryptParams{
+		"recipients": "# alice\n" + aliceAuthorizedKey + "\n" + `no-pty,command="true" ` + bobAuthorizedKey,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{
+		"recipients": sshFingerprint(t, aliceAuthorizedKey) + "," + sshFingerprint(t, bobAuthorizedKey),
+		"v":          "1",
+	}, decryptParams)
+
+	for _, identityFile := range []string{aliceKey, testSSHEd25519Key} {
+		SetSSHIdentityFile(identityFile)
+		plaintext, err := sshCrypter.Decrypt(secret, decryptParams)
+		assert.NoError(t, err)
+		assert.Equal(t, "mypass", plaintext)
+	}
+
+	SetSSHIdentityFile(eveKey)
+	_, err = sshCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error decrypting secret: no identity matched any of the recipients")
+}
+
+func TestSSHPassphrase(t *testing.T) {
+	defer SetSSHPassphraseProvider(nil)
+	os.Setenv(SSHIdentityFileEnv, testSSHEd25519Key)
+	defer os.Unsetenv(SSHIdentityFileEnv)
+
+	for _, keyFile := range []string{testSSHProtectedEd25519Key, testSSHProtectedRSAKey} {
+		sshCrypter := SSHCrypter{}
+		secret, decryptParams, err := sshCrypter.Encrypt("mypass", EncryptParams{
+			"recipients": readSSHAuthorizedKey(t, keyFile),
+		})
+		assert.NoError(t, err)
+
+		// keys the secret is not encrypted to are never decrypted
+		prompts := 0
+		SetSSHPassphraseProvider(PasswordProviderFunc(func() ([]byte, error) {
+			prompts++
+			return []byte("mypassphrase"), nil
+		}))
+		_, err = sshCrypter.Decrypt(secret, decryptParams)
+		assert.EqualError(t, err, "Error decrypting secret: no identity matched any of the recipients")
+		assert.Equal(t, 0, prompts)
+
+		SetSSHIdentityFile(keyFile)
+		plaintext, err := sshCrypter.Decrypt(secret, decryptParams)
+		assert.NoError(t, err)
+		assert.Equal(t, "mypass", plaintext)
+		assert.Equal(t, 1, prompts)
+
+		SetSSHPassphraseProvider(PasswordProviderFunc(func() ([]byte, error) {
+			return []byte("wrong"), nil
+		}))
+		_, err = sshCrypter.Decrypt(secret, decryptParams)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to decrypt SSH key file")
+
+		SetSSHPassphraseProvider(PasswordProviderFunc(func() ([]byte, error) {
+			return nil, fmt.Errorf("no passphrase")
+		}))
+		_, err = sshCrypter.Decrypt(secret, decryptParams)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "no passphrase")
+		SetSSHIdentityFile("")
+	}
+}
+
+func TestSSHInvalidRecipients(t *testing.T) {
+	_, _, err := SSHCrypter{}.Encrypt("mypass", EncryptParams{"recipients": "# nobody\n"})
+	assert.EqualError(t, err, "Missing recipients parameter!")
+
+	_, _, err = SSHCrypter{}.Encrypt("mypass", EncryptParams{"recipients": "ssh-ed25519 notakey"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid SSH public key 'ssh-ed25519 notakey'")
+
+	ecdsaKey := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg="
+	_, _, err = SSHCrypter{}.Encrypt("mypass", EncryptParams{"recipients": ecdsaKey})
+	assert.EqualError(t, err, "Unsupported SSH key type ecdsa-sha2-nistp256, use an ssh-ed25519 or ssh-rsa key")
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// SSMCrypter references values kept in AWS SSM Parameter Store, usually
+// SecureString parameters, so that config files can refer to them like to
+// encrypted secrets. The "ciphertext" is the parameter name, and decrypting
+// fetches the parameter's value with decryption.
+type SSMCrypter struct{}
+
+const ssmVersion = "1"
+
+// SSMEndpointEnv names the environment variable overriding the SSM endpoint,
+// e.g. to use LocalStack.
+const SSMEndpointEnv = "SECRETCRYPT_SSM_ENDPOINT"
+
+var ssmEndpoint string
+var ssmClients = make(map[string]ssmiface.SSMAPI)
+var ssmLock sync.RWMutex
+
+// SetSSMEndpoint overrides the SSM endpoint URL for all regions. It takes
+// precedence over the endpoint in the AWS configuration, which in turn takes
+// precedence over the SECRETCRYPT_SSM_ENDPOINT environment variable. Passing
+// "" removes the override.
+func SetSSMEndpoint(endpoint string) {
+	ssmLock.Lock()
+	ssmEndpoint = endpoint
+	ssmLock.Unlock()
+	ResetSSMClients()
+}
+
+// ResetSSMClients drops all cached SSM clients, so that they are recreated
+// from the AWS configuration when next used.
+func ResetSSMClients() {
+	ssmLock.Lock()
+	defer ssmLock.Unlock()
+	ssmClients = make(map[string]ssmiface.SSMAPI)
+}
+
+func ssmClient(region string) (ssmiface.SSMAPI, error) {
+	ssmLock.RLock()
+	client, exists := ssmClients[region]
+	ssmLock.RUnlock()
+	if exists {
+		return client, nil
+	}
+
+	sess, serviceConfig, err := awsSession(region)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating AWS session: %s", err)
+	}
+	ssmLock.Lock()
+	defer ssmLock.Unlock()
+	if client, exists := ssmClients[region]; exists {
+		return client, nil
+	}
+	endpoint := ssmEndpoint
+	if endpoint == "" && awsConfiguredEndpoint(sess, serviceConfig) == "" {
+		endpoint = os.Getenv(SSMEndpointEnv)
+	}
+	if endpoint != "" {
+		serviceConfig.WithEndpoint(endpoint)
+	}
+	client = ssm.New(sess, serviceConfig)
+	ssmClients[region] = client
+	return client, nil
+}
+
+// getSSMParameter fetches a parameter, at the given version if not empty.
+func getSSMParameter(ctx context.Context, region, name, version string, withDecryption bool) (*ssm.Parameter, error) {
+	client, err := ssmClient(region)
+	if err != nil {
+		return nil, err
+	}
+	selector := name
+	if version != "" {
+		selector += ":" + version
+	}
+	resp, err := client.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(selector),
+		WithDecryption: aws.Bool(withDecryption),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error fetching SSM parameter '%s': %s", selector, err)
+	}
+	return resp.Parameter, nil
+}
+
+func (c SSMCrypter) Name() string {
+	return "ssm"
+}
+
+// Encrypt checks that the parameter named by the "name" encrypt parameter
+// exists and returns a reference to it. The plaintext must be empty, as the
+// value is managed in Parameter Store.
+func (c SSMCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	if plaintext != "" {
+		return Ciphertext(""), nil, fmt.Errorf("The ssm crypter references existing parameters and cannot encrypt plaintexts")
+	}
+	for _, param := range []string{"region", "name"} {
+		if encryptParams[param] == "" {
+			return Ciphertext(""), nil, fmt.Errorf("Missing %s parameter!", param)
+		}
+	}
+	region, name, version := encryptParams["region"], encryptParams["name"], encryptParams["version"]
+
+	if _, err := getSSMParameter(context.Background(), region, name, version, false); err != nil {
+		return Ciphertext(""), nil, err
+	}
+	decryptParams := DecryptParams{"region": region}
+	if version != "" {
+		decryptParams["version"] = version
+	}
+	return Ciphertext(name), withVersion(ssmVersion, decryptParams), nil
+}
+
+func (c SSMCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.DecryptContext(context.Background(), ciphertext, decryptParams)
+}
+
+func (c SSMCrypter) DecryptContext(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(ctx, c.Name(), ciphertext, decryptParams)
+}
+
+func (c SSMCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c SSMCrypter) decryptV1(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	region, ok := decryptParams["region"]
+	if !ok {
+		return "", fmt.Errorf("Missing region parameter!")
+	}
+	parameter, err := getSSMParameter(ctx, region, string(ciphertext), decryptParams["version"], true)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(parameter.Value), nil
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSSM is an in-process stand-in for SSM Parameter Store speaking its JSON
+// protocol. SecureString values are only returned in the clear when decryption
+// is requested.
+type fakeSSM struct {
+	*httptest.Server
+
+	lock       sync.Mutex
+	parameters map[string][]string
+	requests   []fakeSSMRequest
+}
+
+type fakeSSMRequest struct {
+	Name           string
+	WithDecryption bool
+}
+
+func newFakeSSM() *fakeSSM {
+	f := &fakeSSM{parameters: make(map[string][]string)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeSSM) put(name, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.parameters[name] = append(f.parameters[name], value)
+}
+
+func (f *fakeSSM) requestLog() []fakeSSMRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]fakeSSMRequest(nil), f.requests...)
+}
+
+func (f *fakeSSM) handle(w http.ResponseWriter, r *http.Request) {
+	var req fakeSSMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		failAWS(w, "SerializationException", err.Error())
+		return
+	}
+	if operation := r.Header.Get("X-Amz-Target"); operation != "AmazonSSM.GetParameter" {
+		failAWS(w, "UnknownOperationException", operation)
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, req)
+
+	name, selector := req.Name, ""
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, selector = name[:i], name[i+1:]
+	}
+	versions, exists := f.parameters[name]
+	if !exists {
+		failAWS(w, "ParameterNotFound", "")
+		return
+	}
+	version := len(versions)
+	if selector != "" {
+		var err error
+		version, err = strconv.Atoi(selector)
+		if err != nil || version < 1 || version > len(versions) {
+			failAWS(w, "ParameterVersionNotFound", "")
+			return
+		}
+	}
+	value := versions[version-1]
+	if !req.WithDecryption {
+		value = "AQICAHh-encrypted"
+	}
+	respondAWS(w, map[string]interface{}{
+		"Parameter": map[string]interface{}{
+			"Name":    name,
+			"Type":    "SecureString",
+			"Value":   value,
+			"Version": version,
+		},
+	})
+}
+
+func TestSSM(t *testing.T) {
+	fake := newFakeSSM()
+	defer fake.Close()
+	defer resetAWSConfigs()
+	useFakeAWSCredentials()
+	SetSSMEndpoint(fake.URL)
+	defer SetSSMEndpoint("")
+	fake.put("/myservice/db/password", "oldpass")
+	fake.put("/myservice/db/password", "mypass")
+
+	ssmCrypter := SSMCrypter{}
+	ciphertext, decryptParams, err := ssmCrypter.Encrypt("", EncryptParams{
+		"region": "us-east-1",
+		"name":   "/myservice/db/password",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Ciphertext("/myservice/db/password"), ciphertext)
+	assert.Equal(t, DecryptParams{"region": "us-east-1", "v": "1"}, decryptParams)
+	assert.Equal(t, []fakeSSMRequest{{"/myservice/db/password", false}}, fake.requestLog())
+
+	plaintext, err := ssmCrypter.Decrypt(ciphertext, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, fakeSSMRequest{"/myservice/db/password", true}, fake.requestLog()[1])
+
+	ciphertext, decryptParams, err = ssmCrypter.Encrypt("", EncryptParams{
+		"region":  "us-east-1",
+		"name":    "/myservice/db/password",
+		"version": "1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{"region": "us-east-1", "version": "1", "v": "1"}, decryptParams)
+	plaintext, err = ssmCrypter.Decrypt(ciphertext, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "oldpass", plaintext)
+}
+
+func TestSSMErrors(t *testing.T) {
+	fake := newFakeSSM()
+	defer fake.Close()
+	defer resetAWSConfigs()
+	useFakeAWSCredentials()
+	os.Setenv(SSMEndpointEnv, fake.URL)
+	defer os.Unsetenv(SSMEndpointEnv)
+	fake.put("/myservice/db/password", "mypass")
+
+	ssmCrypter := SSMCrypter{}
+	_, _, err := ssmCrypter.Encrypt("mypass", EncryptParams{"region": "us-east-1", "name": "/myservice/db/password"})
+	assert.EqualError(t, err, "The ssm crypter references existing parameters and cannot encrypt plaintexts")
+	_, _, err = ssmCrypter.Encrypt("", EncryptParams{"name": "/myservice/db/password"})
+	assert.EqualError(t, err, "Missing region parameter!")
+	_, _, err = ssmCrypter.Encrypt("", EncryptParams{"region": "us-east-1"})
+	assert.EqualError(t, err, "Missing name parameter!")
+
+	_, _, err = ssmCrypter.Encrypt("", EncryptParams{"region": "us-east-1", "name": "/nosuchparameter"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Error fetching SSM parameter '/nosuchparameter': ParameterNotFound")
+
+	_, err = ssmCrypter.Decrypt("/myservice/db/password", DecryptParams{"region": "us-east-1", "version": "2"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Error fetching SSM parameter '/myservice/db/password:2': ParameterVersionNotFound")
+
+	_, err = ssmCrypter.Decrypt("/myservice/db/password", DecryptParams{"v": "1"})
+	assert.EqualError(t, err, "Missing region parameter!")
+}
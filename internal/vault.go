@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// VaultCrypter encrypts secrets with the Transit secrets engine of
+// HashiCorp Vault.
+type VaultCrypter struct{}
+
+const vaultVersion = "1"
+
+const defaultVaultMount = "transit"
+
+// vaultPathSegment matches a single segment of a Vault API path, so that
+// mounts and key names from secrets cannot redirect requests to other paths.
+var vaultPathSegment = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// checkVaultKeyPath checks that the mount is one or more path segments and
+// the key a single one.
+func checkVaultKeyPath(mount, key string) error {
+	for _, segment := range strings.Split(mount, "/") {
+		if !vaultPathSegment.MatchString(segment) {
+			return fmt.Errorf("Invalid mount parameter '%s'", mount)
+		}
+	}
+	if !vaultPathSegment.MatchString(key) {
+		return fmt.Errorf("Invalid key parameter '%s'", key)
+	}
+	return nil
+}
+
+// VaultConfig configures how the vault crypter reaches and authenticates to
+// Vault.
+type VaultConfig struct {
+	// Address is the Vault server URL. Defaults to the VAULT_ADDR environment
+	// variable.
+	Address string
+	// Namespace is the Vault Enterprise namespace. Defaults to the
+	// VAULT_NAMESPACE environment variable.
+	Namespace string
+	// Auth logs in to Vault. Defaults to VaultTokenAuth with the VAULT_TOKEN
+	// environment variable.
+	Auth VaultAuth
+	// HTTPClient overrides the HTTP client.
+	HTTPClient *http.Client
+}
+
+// VaultAuth logs in to Vault and returns a client token.
+type VaultAuth interface {
+	Login(ctx context.Context, login VaultLoginFunc) (string, error)
+}
+
+// VaultLoginFunc writes data to a Vault auth path, e.g.
+// auth/approle/login, and returns the client token of the response.
+type VaultLoginFunc func(ctx context.Context, path string, data map[string]string) (string, error)
+
+// VaultTokenAuth uses a fixed token. An empty Token is read from the
+// VAULT_TOKEN environment variable.
+type VaultTokenAuth struct {
+	Token string
+}
+
+func (a VaultTokenAuth) Login(ctx context.Context, login VaultLoginFunc) (string, error) {
+	token := a.Token
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if token == "" {
+		return "", fmt.Errorf("No Vault token, set VAULT_TOKEN or configure Vault auth")
+	}
+	return token, nil
+}
+
+// VaultAppRoleAuth logs in with the AppRole auth method.
+type VaultAppRoleAuth struct {
+	// Mount is the auth method's mount path. Defaults to approle.
+	Mount    string
+	RoleID   string
+	SecretID string
+}
+
+func (a VaultAppRoleAuth) Login(ctx context.Context, login VaultLoginFunc) (string, error) {
+	mount := a.Mount
+	if mount == "" {
+		mount = "approle"
+	}
+	return login(ctx, "auth/"+mount+"/login", map[string]string{
+		"role_id":   a.RoleID,
+		"secret_id": a.SecretID,
+	})
+}
+
+const defaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// VaultKubernetesAuth logs in with the Kubernetes auth method, using the
+// pod's service account token.
+type VaultKubernetesAuth struct {
+	// Mount is the auth method's mount path. Defaults to kubernetes.
+	Mount string
+	Role  string
+	// TokenPath is the service account token file. Defaults to the token
+	// mounted into pods.
+	TokenPath string
+}
+
+func (a VaultKubernetesAuth) Login(ctx context.Context, login VaultLoginFunc) (string, error) {
+	mount := a.Mount
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	tokenPath := a.TokenPath
+	if tokenPath == "" {
+		tokenPath = defaultKubernetesTokenPath
+	}
+	jwt, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		return "", fmt.Errorf("Error reading Kubernetes service account token: %s", err)
+	}
+	return login(ctx, "auth/"+mount+"/login", map[string]string{
+		"role": a.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+}
+
+// vaultTokens holds the configuration and caches the client token, which is
+// kept until Vault rejects it.
+var vaultTokens = &tokenCache{
+	fetch:           vaultLogin,
+	cacheUnexpiring: true,
+	rejectedStatus:  http.StatusForbidden,
+	config:          VaultConfig{},
+}
+
+// SetVaultConfig sets how the vault crypter reaches and authenticates to
+// Vault. A token obtained with the previous configuration is dropped.
+func SetVaultConfig(config VaultConfig) {
+	vaultTokens.setConfig(config)
+}
+
+func (c VaultCrypter) Name() string {
+	return "vault"
+}
+
+func (c VaultCrypter) Encrypt(plaintext string, encryptParams EncryptParams) (Ciphertext, DecryptParams, error) {
+	key, ok := encryptParams["key"]
+	if !ok {
+		return Ciphertext(""), nil, fmt.Errorf("Missing key parameter!")
+	}
+	mount := encryptParams["mount"]
+	if mount == "" {
+		mount = defaultVaultMount
+	}
+	if err := checkVaultKeyPath(mount, key); err != nil {
+		return Ciphertext(""), nil, err
+	}
+
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	err := vaultWrite(context.Background(), mount+"/encrypt/"+key, map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte(plaintext)),
+	}, &resp)
+	if err != nil {
+		return Ciphertext(""), nil, err
+	}
+
+	decryptParams := DecryptParams{
+		"mount": mount,
+		"key":   key,
+	}
+	return Ciphertext(resp.Data.Ciphertext), withVersion(vaultVersion, decryptParams), nil
+}
+
+func (c VaultCrypter) Decrypt(ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.DecryptContext(context.Background(), ciphertext, decryptParams)
+}
+
+func (c VaultCrypter) DecryptContext(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	return c.decrypters().decrypt(ctx, c.Name(), ciphertext, decryptParams)
+}
+
+func (c VaultCrypter) decrypters() decrypters {
+	return decrypters{
+		"1": c.decryptV1,
+	}
+}
+
+func (c VaultCrypter) decryptV1(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	mount, ok := decryptParams["mount"]
+	if !ok {
+		return "", fmt.Errorf("Missing mount parameter!")
+	}
+	key, ok := decryptParams["key"]
+	if !ok {
+		return "", fmt.Errorf("Missing key parameter!")
+	}
+	if err := checkVaultKeyPath(mount, key); err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	err := vaultWrite(ctx, mount+"/decrypt/"+key, map[string]string{
+		"ciphertext": string(ciphertext),
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return "", fmt.Errorf("Vault returned invalid plaintext: %s", err)
+	}
+	return string(plaintext), nil
+}
+
+// vaultWrite writes data to a Vault API path with the current client token,
+// logging in again once if Vault rejects the token.
+func vaultWrite(ctx context.Context, path string, data map[string]string, out interface{}) error {
+	return vaultTokens.call(ctx, nil, func(config interface{}, token string) (int, error) {
+		return vaultRequest(ctx, config.(VaultConfig), token, path, data, out)
+	})
+}
+
+func vaultLogin(ctx context.Context, c interface{}) (string, time.Time, error) {
+	config := c.(VaultConfig)
+	auth := config.Auth
+	if auth == nil {
+		auth = VaultTokenAuth{}
+	}
+	token, err := auth.Login(ctx, func(ctx context.Context, path string, data map[string]string) (string, error) {
+		var resp struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		if _, err := vaultRequest(ctx, config, "", path, data, &resp); err != nil {
+			return "", err
+		}
+		if resp.Auth.ClientToken == "" {
+			return "", fmt.Errorf("Vault returned no client token")
+		}
+		return resp.Auth.ClientToken, nil
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Error logging in to Vault: %s", err)
+	}
+	return token, time.Time{}, nil
+}
+
+// vaultRequest posts data to a Vault API path and decodes the response into
+// out. It returns the HTTP status code along with any error.
+func vaultRequest(ctx context.Context, config VaultConfig, token, path string, data map[string]string, out interface{}) (int, error) {
+	address := config.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return 0, fmt.Errorf("No Vault address, set VAULT_ADDR or configure the Vault address")
+	}
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	header := make(http.Header)
+	if token != "" {
+		header.Set("X-Vault-Token", token)
+	}
+	if namespace != "" {
+		header.Set("X-Vault-Namespace", namespace)
+	}
+
+	var vaultErr struct {
+		Errors []string `json:"errors"`
+	}
+	url := strings.TrimRight(address, "/") + "/v1/" + path
+	status, err := sendJSON(ctx, config.HTTPClient, "POST", url, header, data, out, &vaultErr)
+	if err != nil {
+		return status, fmt.Errorf("Error calling Vault: %s", err)
+	}
+	if status != http.StatusOK {
+		return status, fmt.Errorf("Vault error %d on %s: %s", status, path, strings.Join(vaultErr.Errors, "; "))
+	}
+	return status, nil
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVault is an in-process stand-in for the Vault Transit secrets engine
+// and the AppRole and Kubernetes auth methods.
+type fakeVault struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	tokens    map[string]bool
+	blobs     map[string]string
+	logins    int
+	requests  int
+	namespace string
+}
+
+func newFakeVault() *fakeVault {
+	f := &fakeVault{
+		tokens: map[string]bool{"root": true},
+		blobs:  make(map[string]string),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeVault) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+	f.namespace = r.Header.Get("X-Vault-Namespace")
+
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.fail(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	switch {
+	case path == "auth/approle/login" && req["role_id"] == "myrole" && req["secret_id"] == "mysecret",
+		path == "auth/kubernetes/login" && req["role"] == "myrole" && req["jwt"] == "myjwt":
+		f.logins++
+		token := fmt.Sprintf("s.login%d", f.logins)
+		f.tokens[token] = true
+		respondJSON(w, http.StatusOK, map[string]interface{}{"auth": map[string]string{"client_token": token}})
+		return
+	case strings.HasPrefix(path, "auth/"):
+		f.fail(w, http.StatusBadRequest, "invalid credentials")
+		return
+	}
+
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		f.fail(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	switch path {
+	case "transit/encrypt/mykey", "secret-transit/encrypt/mykey":
+		ciphertext := "vault:v1:" + base64.StdEncoding.EncodeToString([]byte(path+req["plaintext"]))
+		f.blobs[ciphertext] = req["plaintext"]
+		respondJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]string{"ciphertext": ciphertext}})
+	case "transit/decrypt/mykey", "secret-transit/decrypt/mykey":
+		plaintext, exists := f.blobs[req["ciphertext"]]
+		if !exists {
+			f.fail(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]string{"plaintext": plaintext}})
+	default:
+		f.fail(w, http.StatusNotFound, "no handler for route")
+	}
+}
+
+func (f *fakeVault) requestCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.requests
+}
+
+func (f *fakeVault) revokeTokens() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tokens = make(map[string]bool)
+}
+
+func (f *fakeVault) fail(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, map[string][]string{"errors": {message}})
+}
+
+func TestVault(t *testing.T) {
+	fake := newFakeVault()
+	defer fake.Close()
+	defer SetVaultConfig(VaultConfig{})
+	SetVaultConfig(VaultConfig{
+		Address:   fake.URL,
+		Namespace: "myteam",
+		Auth:      VaultTokenAuth{Token: "root"},
+	})
+
+	vaultCrypter := VaultCrypter{}
+	secret, decryptParams, err := vaultCrypter.Encrypt("mypass", EncryptParams{"key": "mykey"})
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{"mount": "transit", "key": "mykey", "v": "1"}, decryptParams)
+	assert.True(t, strings.HasPrefix(string(secret), "vault:v1:"))
+	assert.Equal(t, "myteam", fake.namespace)
+
+	plaintext, err := vaultCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	plaintext, err = vaultCrypter.DecryptContext(ctx, secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	_, err = vaultCrypter.Decrypt("vault:v1:bm90aGluZw==", decryptParams)
+	assert.EqualError(t, err, "Vault error 400 on transit/decrypt/mykey: invalid ciphertext")
+
+	_, err = vaultCrypter.Decrypt(secret, DecryptParams{"key": "mykey"})
+	assert.EqualError(t, err, "Missing mount parameter!")
+
+	_, _, err = vaultCrypter.Encrypt("mypass", EncryptParams{})
+	assert.EqualError(t, err, "Missing key parameter!")
+}
+
+func TestVaultInvalidPaths(t *testing.T) {
+	fake := newFakeVault()
+	defer fake.Close()
+	defer SetVaultConfig(VaultConfig{})
+	SetVaultConfig(VaultConfig{Address: fake.URL, Auth: VaultTokenAuth{Token: "root"}})
+
+	vaultCrypter := VaultCrypter{}
+	for _, tc := range []struct {
+		mount string
+		key   string
+		err   string
+	}{
+		{"transit", "../../sys/raw/mykey", "Invalid key parameter '../../sys/raw/mykey'"},
+		{"transit", "mykey?version=1", "Invalid key parameter 'mykey?version=1'"},
+		{"transit", "mykey#", "Invalid key parameter 'mykey#'"},
+		{"transit", "", "Invalid key parameter ''"},
+		{"/sys", "mykey", "Invalid mount parameter '/sys'"},
+		{"transit/..", "mykey", "Invalid mount parameter 'transit/..'"},
+		{"transit//x", "mykey", "Invalid mount parameter 'transit//x'"},
+	} {
+		_, err := vaultCrypter.Decrypt("vault:v1:bm90aGluZw==", DecryptParams{"mount": tc.mount, "key": tc.key, "v": "1"})
+		assert.EqualError(t, err, tc.err)
+		_, _, err = vaultCrypter.Encrypt("mypass", EncryptParams{"mount": tc.mount, "key": tc.key})
+		assert.EqualError(t, err, tc.err)
+	}
+	assert.Equal(t, 0, fake.requestCount())
+
+	// mounts may be nested
+	assert.NoError(t, checkVaultKeyPath("team/transit", "my.key"))
+}
+
+func TestVaultMount(t *testing.T) {
+	fake := newFakeVault()
+	defer fake.Close()
+	defer SetVaultConfig(VaultConfig{})
+	SetVaultConfig(VaultConfig{Address: fake.URL, Auth: VaultTokenAuth{Token: "root"}})
+
+	vaultCrypter := VaultCrypter{}
+	secret, decryptParams, err := vaultCrypter.Encrypt("mypass", EncryptParams{
+		"mount": "secret-transit",
+		"key":   "mykey",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "secret-transit", decryptParams["mount"])
+
+	plaintext, err := vaultCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+}
+
+func TestVaultEnv(t *testing.T) {
+	fake := newFakeVault()
+	defer fake.Close()
+	defer SetVaultConfig(VaultConfig{})
+	SetVaultConfig(VaultConfig{})
+	os.Setenv("VAULT_ADDR", fake.URL)
+	defer os.Unsetenv("VAULT_ADDR")
+
+	_, _, err := VaultCrypter{}.Encrypt("mypass", EncryptParams{"key": "mykey"})
+	assert.EqualError(t, err, "Error logging in to Vault: No Vault token, set VAULT_TOKEN or configure Vault auth")
+
+	os.Setenv("VAULT_TOKEN", "root")
+	defer os.Unsetenv("VAULT_TOKEN")
+	_, _, err = VaultCrypter{}.Encrypt("mypass", EncryptParams{"key": "mykey"})
+	assert.NoError(t, err)
+}
+
+func TestVaultAppRoleAuth(t *testing.T) {
+	fake := newFakeVault()
+	defer fake.Close()
+	defer SetVaultConfig(VaultConfig{})
+	SetVaultConfig(VaultConfig{
+		Address: fake.URL,
+		Auth:    VaultAppRoleAuth{RoleID: "myrole", SecretID: "mysecret"},
+	})
+
+	vaultCrypter := VaultCrypter{}
+	secret, decryptParams, err := vaultCrypter.Encrypt("mypass", EncryptParams{"key": "mykey"})
+	assert.NoError(t, err)
+	plaintext, err := vaultCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, 1, fake.logins, "token is reused")
+
+	// an expired token is replaced by logging in again
+	fake.revokeTokens()
+	plaintext, err = vaultCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, 2, fake.logins)
+
+	SetVaultConfig(VaultConfig{
+		Address: fake.URL,
+		Auth:    VaultAppRoleAuth{RoleID: "myrole", SecretID: "wrong"},
+	})
+	_, err = vaultCrypter.Decrypt(secret, decryptParams)
+	assert.EqualError(t, err, "Error logging in to Vault: Vault error 400 on auth/approle/login: invalid credentials")
+}
+
+func TestVaultKubernetesAuth(t *testing.T) {
+	fake := newFakeVault()
+	defer fake.Close()
+	defer SetVaultConfig(VaultConfig{})
+
+	tokenFile, err := ioutil.TempFile("", "secretcrypt-jwt")
+	assert.NoError(t, err)
+	defer os.Remove(tokenFile.Name())
+	_, _ = tokenFile.WriteString("myjwt\n")
+	tokenFile.Close()
+
+	SetVaultConfig(VaultConfig{
+		Address: fake.URL,
+		Auth:    VaultKubernetesAuth{Role: "myrole", TokenPath: tokenFile.Name()},
+	})
+	vaultCrypter := VaultCrypter{}
+	secret, decryptParams, err := vaultCrypter.Encrypt("mypass", EncryptParams{"key": "mykey"})
+	assert.NoError(t, err)
+	plaintext, err := vaultCrypter.Decrypt(secret, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+	assert.Equal(t, 1, fake.logins)
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+)
+
+// VersionParam is the reserved decrypt parameter holding the format version
+// of a secret. Built-in crypters write it on encryption and use it to pick the
+// matching decryption algorithm. Secrets without it are version 1.
+const VersionParam = "v"
+
+const legacyVersion = "1"
+
+type decryptFunc func(context.Context, Ciphertext, DecryptParams) (string, error)
+
+// decrypters maps secret format versions to the functions decrypting them, so
+// that several generations of a crypter's format can coexist.
+type decrypters map[string]decryptFunc
+
+func (d decrypters) decrypt(ctx context.Context, crypterName string, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+	version, ok := decryptParams[VersionParam]
+	if !ok {
+		version = legacyVersion
+	}
+	decrypt, ok := d[version]
+	if !ok {
+		return "", fmt.Errorf("Unsupported %s secret format version '%s'", crypterName, version)
+	}
+	return decrypt(ctx, ciphertext, decryptParams)
+}
+
+// withVersion returns the decrypt params with the format version set.
+func withVersion(version string, decryptParams DecryptParams) DecryptParams {
+	if decryptParams == nil {
+		decryptParams = make(DecryptParams)
+	}
+	decryptParams[VersionParam] = version
+	return decryptParams
+}
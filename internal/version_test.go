@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecryptersDispatch(t *testing.T) {
+	d := decrypters{
+		"1": func(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+			return "v1:" + string(ciphertext), nil
+		},
+		"2": func(ctx context.Context, ciphertext Ciphertext, decryptParams DecryptParams) (string, error) {
+			return "v2:" + string(ciphertext), nil
+		},
+	}
+
+	plaintext, err := d.decrypt(context.Background(), "test", "abc", DecryptParams{})
+	assert.NoError(t, err)
+	assert.Equal(t, "v1:abc", plaintext, "missing version defaults to 1")
+
+	plaintext, err = d.decrypt(context.Background(), "test", "abc", DecryptParams{"v": "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "v2:abc", plaintext)
+
+	plaintext, err = d.decrypt(context.Background(), "test", "abc", DecryptParams{"v": "3"})
+	assert.EqualError(t, err, "Unsupported test secret format version '3'")
+	assert.Zero(t, plaintext)
+}
+
+func TestBuiltinCryptersWriteVersion(t *testing.T) {
+	ciphertext, decryptParams, err := PlainCrypter{}.Encrypt("mypass", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DecryptParams{"v": "1"}, decryptParams)
+
+	plaintext, err := PlainCrypter{}.Decrypt(ciphertext, decryptParams)
+	assert.NoError(t, err)
+	assert.Equal(t, "mypass", plaintext)
+
+	_, err = PlainCrypter{}.Decrypt(ciphertext, DecryptParams{"v": "99"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,58 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// KMSClientFactory creates the KMS client (a kmsiface.KMSAPI) for a region.
+// Clients are cached per region until ResetKMSClients is called.
+type KMSClientFactory = internal.KMSClientFactory
+
+// SetKMSClientFactory replaces how KMS clients are created, e.g. to inject a
+// fake kmsiface.KMSAPI in tests. Passing nil restores the default factory,
+// which creates clients from the AWS configuration. Cached clients are
+// dropped.
+func SetKMSClientFactory(factory KMSClientFactory) {
+	internal.SetKMSClientFactory(factory)
+}
+
+// ResetKMSClients drops all cached KMS clients, so that they are recreated
+// by the client factory when next used.
+func ResetKMSClients() {
+	internal.ResetKMSClients()
+}
+
+// KMSEndpointEnv names the environment variable overriding the KMS endpoint,
+// e.g. to use a local KMS emulator such as local-kms or LocalStack.
+const KMSEndpointEnv = internal.KMSEndpointEnv
+
+// SetKMSEndpoint overrides the KMS endpoint URL for all regions. It takes
+// precedence over the endpoint in the AWS configuration, which in turn takes
+// precedence over the SECRETCRYPT_KMS_ENDPOINT environment variable. Passing
+// "" removes the override.
+func SetKMSEndpoint(endpoint string) {
+	internal.SetKMSEndpoint(endpoint)
+}
+
+// DataKeyCacheConfig configures the in-process cache of KMS data keys used by
+// envelope encrypted secrets.
+type DataKeyCacheConfig = internal.DataKeyCacheConfig
+
+// EnableKMSDataKeyCache caches unwrapped KMS data keys for the configured max
+// age and max uses, so that envelope encrypted secrets sharing a data key cost
+// a single KMS call. While enabled, envelope encryption also reuses data keys
+// for secrets with the same key ID and encryption context.
+func EnableKMSDataKeyCache(config DataKeyCacheConfig) {
+	internal.EnableKMSDataKeyCache(config)
+}
+
+// DisableKMSDataKeyCache disables the KMS data key cache and wipes all cached
+// data keys.
+func DisableKMSDataKeyCache() {
+	internal.DisableKMSDataKeyCache()
+}
+
+// SetKMSAllowedKeys restricts decryption of KMS secrets to ciphertexts
+// protected by the given key ARNs. For multi-Region keys, list the ARN of
+// every replica used. Passing no ARNs lifts the restriction.
+func SetKMSAllowedKeys(keyARNs ...string) {
+	internal.SetKMSAllowedKeys(keyARNs...)
+}
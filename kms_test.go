@@ -0,0 +1,41 @@
+package secretcrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeKMSClient struct {
+	kmsiface.KMSAPI
+	region string
+}
+
+func (c fakeKMSClient) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{
+		Plaintext: []byte(fmt.Sprintf("%s-%s", c.region, input.CiphertextBlob)),
+	}, nil
+}
+
+func TestKMSClientFactory(t *testing.T) {
+	defer SetKMSClientFactory(nil)
+	SetKMSClientFactory(func(region string) (kmsiface.KMSAPI, error) {
+		return fakeKMSClient{region: region}, nil
+	})
+
+	var config struct {
+		DBPassword Secret
+	}
+	err := json.Unmarshal(
+		[]byte(`{"DBPassword": "kms:region=eu-west-1&v=1:bXlwYXNz"}`),
+		&config,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "eu-west-1-mypass", config.DBPassword.Get())
+}
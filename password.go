@@ -0,0 +1,44 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// PasswordProvider supplies the password used by the password crypter. The
+// crypter wipes the returned slice once it has derived the key.
+type PasswordProvider = internal.PasswordProvider
+
+// TerminalPasswordProvider interactively prompts for the password on the
+// terminal. It is the default.
+type TerminalPasswordProvider = internal.TerminalPasswordProvider
+
+// EnvPasswordProvider reads the password from the named environment variable.
+type EnvPasswordProvider = internal.EnvPasswordProvider
+
+// FilePasswordProvider reads the password from a file, such as a mounted
+// Docker or Kubernetes secret. A trailing newline is ignored.
+type FilePasswordProvider = internal.FilePasswordProvider
+
+// CommandPasswordProvider runs a command and uses its standard output as the
+// password. A trailing newline is ignored.
+type CommandPasswordProvider = internal.CommandPasswordProvider
+
+// PasswordProviderFunc adapts an ordinary function to a PasswordProvider.
+type PasswordProviderFunc = internal.PasswordProviderFunc
+
+// SetPasswordProvider sets where the password crypter gets its password from.
+// Passing nil restores the default interactive terminal prompt.
+func SetPasswordProvider(provider PasswordProvider) {
+	internal.SetPasswordProvider(provider)
+}
+
+// SetPasswordCaching enables or disables caching of passwords for the lifetime
+// of the process, so that one prompt unlocks every secret encrypted with the
+// same password ID. Secrets encrypted without a password ID are never cached.
+// Disabling caching also forgets all cached passwords.
+func SetPasswordCaching(enabled bool) {
+	internal.SetPasswordCaching(enabled)
+}
+
+// ForgetPasswords wipes all cached passwords.
+func ForgetPasswords() {
+	internal.ForgetPasswords()
+}
@@ -0,0 +1,23 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// PGPKeyringEnv names the environment variable holding the path of the
+// OpenPGP keyring used by the pgp crypter.
+const PGPKeyringEnv = internal.PGPKeyringEnv
+
+// SetPGPKeyring sets the path of the OpenPGP keyring, armored or binary, that
+// holds the recipients' public keys when encrypting and the private keys when
+// decrypting, e.g. as exported by `gpg --export-secret-keys`. It takes
+// precedence over the SECRETCRYPT_PGP_KEYRING environment variable. Passing
+// "" removes the override.
+func SetPGPKeyring(path string) {
+	internal.SetPGPKeyring(path)
+}
+
+// SetPGPPassphraseProvider sets the provider of the passphrase protecting the
+// OpenPGP private keys. Passing nil restores the default interactive terminal
+// prompt.
+func SetPGPPassphraseProvider(provider PasswordProvider) {
+	internal.SetPGPPassphraseProvider(provider)
+}
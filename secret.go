@@ -1,6 +1,7 @@
 package secretcrypt
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -11,6 +12,7 @@ import (
 // Decrypting this secret may incur a side-effect such as a call to a remote
 // service for decryption.
 type StrictSecret struct {
+	crypterName   string
 	crypter       internal.Crypter
 	ciphertext    internal.Ciphertext
 	decryptParams internal.DecryptParams
@@ -19,19 +21,23 @@ type StrictSecret struct {
 // Decrypt decrypts the secret and returns the plaintext. Calling Decrypt()
 // may incur side effects such as a call to a remote service for decryption.
 func (s *StrictSecret) Decrypt() (string, error) {
+	return s.DecryptContext(context.Background())
+}
+
+// DecryptContext is like Decrypt, but gives up when ctx is cancelled or its
+// deadline expires.
+func (s *StrictSecret) DecryptContext(ctx context.Context) (string, error) {
 	if s.crypter == nil || s.ciphertext == "" {
 		return "", nil
 	}
-	var err error
-	plaintext, err := s.crypter.Decrypt(s.ciphertext, s.decryptParams)
-	return plaintext, err
+	return internal.DecryptContext(ctx, s.crypter, s.ciphertext, s.decryptParams)
 }
 
 // MarshalText marshalls the secret into its textual representation.
 func (s StrictSecret) MarshalText() (text []byte, err error) {
 	return []byte(fmt.Sprintf(
 		"%s:%s:%s",
-		s.crypter.Name(),
+		s.crypterName,
 		internal.UnparseDecryptParams(s.decryptParams),
 		s.ciphertext,
 	)), nil
@@ -48,7 +54,7 @@ func (s *StrictSecret) UnmarshalText(text []byte) error {
 	}
 
 	var exists bool
-	s.crypter, exists = internal.CryptersMap[tokens[0]]
+	s.crypter, exists = internal.GetCrypter(tokens[0])
 	if !exists {
 		return fmt.Errorf("Invalid crypter name in secret %s", text)
 	}
@@ -59,6 +65,7 @@ func (s *StrictSecret) UnmarshalText(text []byte) error {
 		return fmt.Errorf("Invalid decryption parameters in secret %s: %s", text, err)
 	}
 
+	s.crypterName = tokens[0]
 	s.ciphertext = internal.Ciphertext(tokens[2])
 	return nil
 }
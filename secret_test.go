@@ -1,21 +1,28 @@
 package secretcrypt
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/Zemanta/go-secretcrypt/internal"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestMain(m *testing.M) {
-	internal.CryptersMap["plain"] = internal.PlainCrypter{}
 	flag.Parse()
 	os.Exit(m.Run())
 }
 
+func registerMockCrypter(t *testing.T) *internal.MockCrypter {
+	mockCrypter := &internal.MockCrypter{}
+	assert.NoError(t, RegisterCrypter("mock", mockCrypter))
+	return mockCrypter
+}
+
 func assertStrictSecretValid(t *testing.T, secret StrictSecret) {
 	assert.Equal(t, "plain", secret.crypter.Name())
 	assert.Equal(t, "my-abc", string(secret.ciphertext))
@@ -39,8 +46,8 @@ func TestNewStrictSecret(t *testing.T) {
 }
 
 func TestDecrypt(t *testing.T) {
-	mockCrypter := &internal.MockCrypter{}
-	internal.CryptersMap["mock"] = mockCrypter
+	mockCrypter := registerMockCrypter(t)
+	defer UnregisterCrypter("mock")
 	mockCrypter.On(
 		"Decrypt",
 		internal.Ciphertext("my-abc"),
@@ -58,9 +65,54 @@ func TestDecrypt(t *testing.T) {
 	mockCrypter.AssertExpectations(t)
 }
 
+func TestDecryptContext(t *testing.T) {
+	mockCrypter := registerMockCrypter(t)
+	defer UnregisterCrypter("mock")
+	mockCrypter.On(
+		"Decrypt",
+		internal.Ciphertext("my-abc"),
+		internal.DecryptParams{"k1": "v1"},
+	).Return("myplaintext", nil)
+
+	secret, err := LoadStrictSecret("mock:k1=v1:my-abc")
+	assert.NoError(t, err)
+
+	plaintext, err := secret.DecryptContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "myplaintext", plaintext)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	plaintext, err = secret.DecryptContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Zero(t, plaintext)
+	mockCrypter.AssertNumberOfCalls(t, "Decrypt", 1)
+}
+
+func TestDecryptContextDeadline(t *testing.T) {
+	mockCrypter := registerMockCrypter(t)
+	defer UnregisterCrypter("mock")
+	unblock := make(chan time.Time)
+	defer close(unblock)
+	mockCrypter.On(
+		"Decrypt",
+		internal.Ciphertext("my-abc"),
+		internal.DecryptParams{"k1": "v1"},
+	).WaitUntil(unblock).Return("myplaintext", nil)
+
+	secret, err := LoadStrictSecret("mock:k1=v1:my-abc")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	plaintext, err := secret.DecryptContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Zero(t, plaintext)
+}
+
 func TestNoCaching(t *testing.T) {
-	mockCrypter := &internal.MockCrypter{}
-	internal.CryptersMap["mock"] = mockCrypter
+	mockCrypter := registerMockCrypter(t)
+	defer UnregisterCrypter("mock")
 	mockCrypter.On(
 		"Decrypt",
 		internal.Ciphertext("my-abc"),
@@ -134,6 +186,42 @@ func TestSecretMarshalText(t *testing.T) {
 	assert.Equal(t, "plain:k1=v1&k2=v2:my-abc", string(text))
 }
 
+func TestRegisterCrypter(t *testing.T) {
+	mockCrypter := registerMockCrypter(t)
+	defer UnregisterCrypter("mock")
+	assert.Error(t, RegisterCrypter("mock", mockCrypter), "duplicate name")
+	assert.Error(t, RegisterCrypter("plain", mockCrypter), "duplicate built-in name")
+	assert.Error(t, RegisterCrypter("", mockCrypter), "empty name")
+	assert.Error(t, RegisterCrypter("my:mock", mockCrypter), "name with colon")
+	assert.Error(t, RegisterCrypter("nil", nil), "nil crypter")
+
+	crypters := Crypters()
+	assert.Equal(t, mockCrypter, crypters["mock"])
+	for _, name := range []string{"kms", "local", "password", "plain", "vault", "gcpkms", "azurekv", "age", "pgp", "ssh", "multi", "shamir", "ssm"} {
+		assert.Contains(t, crypters, name)
+	}
+
+	assert.True(t, UnregisterCrypter("mock"))
+	assert.False(t, UnregisterCrypter("mock"))
+	_, err := LoadStrictSecret("mock:k1=v1:my-abc")
+	assert.Error(t, err, "unregistered crypter")
+}
+
+func TestRegisterCrypterAlias(t *testing.T) {
+	assert.NoError(t, RegisterCrypter("myplain", internal.PlainCrypter{}))
+	defer UnregisterCrypter("myplain")
+
+	secret, err := LoadStrictSecret("myplain:k1=v1:my-abc")
+	assert.NoError(t, err)
+	plaintext, err := secret.Decrypt()
+	assert.NoError(t, err)
+	assert.Equal(t, "my-abc", plaintext)
+
+	text, err := secret.MarshalText()
+	assert.NoError(t, err)
+	assert.Equal(t, "myplain:k1=v1:my-abc", string(text))
+}
+
 func TestStrictSecretUnmarshalTextError(t *testing.T) {
 	var ssecret StrictSecret
 	err := ssecret.UnmarshalText([]byte("plain:k1=v1&k2=v2Missing3rdComponent"))
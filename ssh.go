@@ -0,0 +1,33 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// SSHIdentityFileEnv names the environment variable holding the path of the
+// SSH private key used to decrypt ssh secrets.
+const SSHIdentityFileEnv = internal.SSHIdentityFileEnv
+
+// SetSSHIdentityFile sets the path of the ssh-ed25519 or ssh-rsa private key
+// used to decrypt ssh secrets. It takes precedence over the
+// SECRETCRYPT_SSH_IDENTITY_FILE environment variable and the default
+// ~/.ssh/id_ed25519 and ~/.ssh/id_rsa keys. Passing "" removes the override.
+func SetSSHIdentityFile(path string) {
+	internal.SetSSHIdentityFile(path)
+}
+
+// SetSSHPassphraseProvider sets the provider of the passphrase protecting the
+// SSH private keys. Passing nil restores the default interactive terminal
+// prompt.
+func SetSSHPassphraseProvider(provider PasswordProvider) {
+	internal.SetSSHPassphraseProvider(provider)
+}
+
+// SSHAgentSocketEnv names the environment variable holding the ssh-agent
+// socket used by ssh secrets encrypted for an agent.
+const SSHAgentSocketEnv = internal.SSHAgentSocketEnv
+
+// SetSSHAgentSocket sets the path of the ssh-agent socket used to encrypt and
+// decrypt ssh secrets for keys held by an agent. It takes precedence over the
+// SSH_AUTH_SOCK environment variable. Passing "" removes the override.
+func SetSSHAgentSocket(path string) {
+	internal.SetSSHAgentSocket(path)
+}
@@ -0,0 +1,22 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// SSMEndpointEnv names the environment variable overriding the SSM endpoint,
+// e.g. to use LocalStack.
+const SSMEndpointEnv = internal.SSMEndpointEnv
+
+// SetSSMEndpoint overrides the SSM endpoint URL used to fetch ssm secrets for
+// all regions. It takes precedence over the endpoint in the AWS
+// configuration, which in turn takes precedence over the
+// SECRETCRYPT_SSM_ENDPOINT environment variable. Passing "" removes the
+// override.
+func SetSSMEndpoint(endpoint string) {
+	internal.SetSSMEndpoint(endpoint)
+}
+
+// ResetSSMClients drops all cached SSM clients, so that they are recreated
+// from the AWS configuration when next used.
+func ResetSSMClients() {
+	internal.ResetSSMClients()
+}
@@ -0,0 +1,33 @@
+package secretcrypt
+
+import "github.com/Zemanta/go-secretcrypt/internal"
+
+// VaultConfig configures how the vault crypter reaches and authenticates to
+// HashiCorp Vault. Unset fields default to the VAULT_ADDR, VAULT_NAMESPACE
+// and VAULT_TOKEN environment variables.
+type VaultConfig = internal.VaultConfig
+
+// VaultAuth logs in to Vault and returns a client token.
+type VaultAuth = internal.VaultAuth
+
+// VaultLoginFunc writes data to a Vault auth path, e.g. auth/approle/login,
+// and returns the client token of the response. It is passed to
+// VaultAuth.Login.
+type VaultLoginFunc = internal.VaultLoginFunc
+
+// VaultTokenAuth uses a fixed token. An empty Token is read from the
+// VAULT_TOKEN environment variable.
+type VaultTokenAuth = internal.VaultTokenAuth
+
+// VaultAppRoleAuth logs in with the AppRole auth method.
+type VaultAppRoleAuth = internal.VaultAppRoleAuth
+
+// VaultKubernetesAuth logs in with the Kubernetes auth method, using the
+// pod's service account token.
+type VaultKubernetesAuth = internal.VaultKubernetesAuth
+
+// SetVaultConfig sets how the vault crypter reaches and authenticates to
+// Vault. A token obtained with the previous configuration is dropped.
+func SetVaultConfig(config VaultConfig) {
+	internal.SetVaultConfig(config)
+}